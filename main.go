@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/acorn-io/acorn-linkerd-plugin/pkg/controller"
 	"github.com/acorn-io/acorn-linkerd-plugin/pkg/scheme"
@@ -10,7 +12,9 @@ import (
 	"github.com/acorn-io/baaah/pkg/restconfig"
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 )
 
@@ -19,14 +23,47 @@ var (
 
 	debugImageFlag = flag.String("debug-image", "ghcr.io/acorn-io/acorn-linkerd-plugin:main", "the image to use for killing linkerd sidecar")
 
-	clusterDomain = flag.String("cluster-domain", "cluster.local", "The cluster domain that is configured on linkerd")
+	debugImagePullPolicy = flag.String("debug-image-pull-policy", string(corev1.PullAlways), "The pull policy of the debug image: Always, IfNotPresent or Never")
 
-	ingressEndpointName = flag.String("ingress-endpoint-name", "traefik", "The name of the ingress pod endpoint. Used to create policy that allows traffic from ingress to apps")
+	debugImagePullSecret = flag.String("debug-image-pull-secret", "", "The image pull secret the debug image needs. Ephemeral containers use the pull secrets of their pod, pods without the secret aren't shut down with an ephemeral container")
 
-	ingressEndpointNamespace = flag.String("ingress-endpoint-namespace", "traefik", "The namespace of the ingress pod endpoint. Used to create policy that allows traffic from ingress to apps")
+	shutdownSecurityContext = flag.String("shutdown-container-security-context", "", "The security context of the ephemeral shutdown container as JSON. By default it complies with the restricted Pod Security Standard: non-root, no privilege escalation, all capabilities dropped and the RuntimeDefault seccomp profile")
+
+	sidecarShutdown = flag.String("sidecar-shutdown", controller.SidecarShutdownEphemeralContainer, "How to shut down the linkerd sidecar of completed jobs: native-sidecar (have linkerd inject native sidecars into every meshed workload of the projects, which kubernetes shuts down itself), ephemeral-container (launch an ephemeral container with --debug-image) or auto (native-sidecar if kubernetes and linkerd support it, ephemeral-container otherwise)")
+
+	sidecarShutdownTimeout = flag.Duration("sidecar-shutdown-timeout", 5*time.Minute, "How long to retry shutting down the linkerd sidecar of a completed job before escalating")
+
+	sidecarShutdownEscalation = flag.String("sidecar-shutdown-escalation", controller.SidecarShutdownEscalationFailJob, "What to do with a job pod whose sidecar couldn't be shut down within --sidecar-shutdown-timeout: fail-job (fail the Job through its active deadline), delete-pod or none (only emit an Event)")
+
+	clusterDomain = flag.String("cluster-domain", "cluster.local", "The identity trust domain of linkerd. By default it is read from the linkerd-config ConfigMap and this value is only used if the ConfigMap can't be found, setting it overrides the trust domain of linkerd")
+
+	ingressEndpointName = flag.String("ingress-endpoint-name", "traefik", "The name of the ingress controller service. Used to create policy that allows traffic from ingress to apps")
+
+	ingressEndpointNamespace = flag.String("ingress-endpoint-namespace", "traefik", "The namespace of the ingress controller service. Used to create policy that allows traffic from ingress to apps")
+
+	ingressEndpoints = flag.String("ingress-endpoints", "", "Comma separated list of <namespace>/<name> ingress controller services. Overrides --ingress-endpoint-name and --ingress-endpoint-namespace, used when running multiple ingress controllers")
+
+	ingressEndpointSelector = flag.String("ingress-endpoint-selector", "", "Label selector matching the services of additional ingress controllers")
+
+	ingressDiscovery = flag.Bool("ingress-discovery", false, "Discover the ingress controllers to allow traffic from through the IngressClasses of the cluster. The default ingress endpoint is only used in addition when it is set explicitly")
+
+	ingressAuthMode = flag.String("ingress-auth-mode", controller.IngressAuthModeAuto, "How to authenticate traffic from ingress: identity (service account identity of a meshed ingress controller), network (ingress pod IPs) or auto (identity if the ingress controller is meshed)")
+
+	aggregateNetworks = flag.Bool("aggregate-networks", false, "Merge contiguous pod IPs into wider CIDRs in the generated NetworkAuthentications")
+
+	identityRefs = flag.String("identity-refs", controller.IdentityRefsAuto, "How to reference identities in the generated MeshTLSAuthentications: enabled (identityRefs to ServiceAccounts and Namespaces, independent of the cluster domain), disabled (identity strings built from --cluster-domain) or auto (enabled if the installed linkerd CRDs support identityRefs)")
+
+	networkPolicies = flag.Bool("network-policies", false, "Also enforce the isolation of strictly isolated projects with NetworkPolicies, which covers unmeshed pods and traffic that bypasses the linkerd proxy")
+
+	perAppIdentities = flag.Bool("per-app-identities", false, "Only trust the service accounts used by the acorn managed pods of a project instead of every service account of its app namespaces")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "uninstall" {
+		uninstall(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 
 	fmt.Printf("Version: %s\n", version.Get())
@@ -35,7 +72,9 @@ func main() {
 	}
 
 	logrus.Infof("Using debug image %s", *debugImageFlag)
-	logrus.Infof("Using cluster domain %s", *clusterDomain)
+	if isFlagSet("cluster-domain") {
+		logrus.Infof("Using cluster domain %s", *clusterDomain)
+	}
 
 	config, err := restconfig.Default()
 	if err != nil {
@@ -46,18 +85,88 @@ func main() {
 	config.NegotiatedSerializer = scheme.Codecs
 
 	k8s := kubernetes.NewForConfigOrDie(config)
+	apiExtensions := apiextensionsclient.NewForConfigOrDie(config)
+
+	var endpoints []controller.IngressEndpoint
+	if !*ingressDiscovery || isFlagSet("ingress-endpoint-name") || isFlagSet("ingress-endpoint-namespace") {
+		endpoints = append(endpoints, controller.IngressEndpoint{
+			Namespace: *ingressEndpointNamespace,
+			Name:      *ingressEndpointName,
+		})
+	}
+	if *ingressEndpoints != "" {
+		endpoints, err = controller.ParseIngressEndpoints(*ingressEndpoints)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	c, err := client.New(config, client.Options{
+		Scheme: scheme.Scheme,
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
 
 	ctx := signals.SetupSignalHandler()
 	if err := controller.Start(ctx, controller.Options{
-		K8s:           k8s,
-		DebugImage:    *debugImageFlag,
-		ClusterDomain: *clusterDomain,
+		K8s:                       k8s,
+		APIExtensions:             apiExtensions,
+		Client:                    c,
+		DebugImage:                *debugImageFlag,
+		DebugImagePullPolicy:      *debugImagePullPolicy,
+		DebugImagePullSecret:      *debugImagePullSecret,
+		ShutdownSecurityContext:   *shutdownSecurityContext,
+		SidecarShutdown:           *sidecarShutdown,
+		SidecarShutdownTimeout:    *sidecarShutdownTimeout,
+		SidecarShutdownEscalation: *sidecarShutdownEscalation,
+		ClusterDomain:             *clusterDomain,
+		ClusterDomainOverride:     isFlagSet("cluster-domain"),
 
-		IngressEndpointName:      *ingressEndpointName,
-		IngressEndpointNamespace: *ingressEndpointNamespace,
+		IngressEndpoints:        endpoints,
+		IngressEndpointSelector: *ingressEndpointSelector,
+		IngressDiscovery:        *ingressDiscovery,
+		IngressAuthMode:         *ingressAuthMode,
+		AggregateNetworks:       *aggregateNetworks,
+		PerAppIdentities:        *perAppIdentities,
+		IdentityRefs:            *identityRefs,
+		NetworkPolicies:         *networkPolicies,
 	}); err != nil {
 		logrus.Fatal(err)
 	}
 	<-ctx.Done()
 	logrus.Fatal(ctx.Err())
 }
+
+// uninstall removes everything the plugin created from the cluster. The controller has to be stopped first.
+func uninstall(args []string) {
+	flags := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only print what would be removed")
+	_ = flags.Parse(args)
+
+	config, err := restconfig.Default()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	c, err := client.New(config, client.Options{
+		Scheme: scheme.Scheme,
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	if err := controller.Uninstall(signals.SetupSignalHandler(), c, *dryRun, os.Stdout); err != nil {
+		logrus.Fatal(err)
+	}
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"sort"
+
+	"github.com/acorn-io/baaah/pkg/name"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	gatewayapiv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	policyv1alpha1 "github.com/linkerd/linkerd2/controller/gen/apis/policy/v1alpha1"
+	serverv1beta1 "github.com/linkerd/linkerd2/controller/gen/apis/server/v1beta1"
+)
+
+const (
+	routerMeshTLSAuthenticationName = "acorn-router-mesh-authentication"
+)
+
+// listRouterServers returns the Servers in acorn-system that acorn created for the routers of a project
+func listRouterServers(req router.Request, project string) ([]serverv1beta1.Server, error) {
+	var servers serverv1beta1.ServerList
+	if err := req.Client.List(req.Ctx, &servers, &client.ListOptions{
+		Namespace: acornSystemNamespace,
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			appNamespaceLabel: project,
+		}),
+	}); err != nil {
+		return nil, err
+	}
+	return servers.Items, nil
+}
+
+// listRouterPods returns the running pods selected by any of the router Servers, sorted by name. The pod selector of a
+// Server is a full label selector, so both matchLabels and matchExpressions are honored.
+func listRouterPods(req router.Request, servers []serverv1beta1.Server) ([]corev1.Pod, error) {
+	seen := map[string]bool{}
+	var result []corev1.Pod
+	for _, server := range servers {
+		if server.Spec.PodSelector == nil {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(server.Spec.PodSelector)
+		if err != nil {
+			logrus.Warnf("Ignoring router server %s/%s with invalid pod selector: %v", server.Namespace, server.Name, err)
+			continue
+		}
+
+		var pods corev1.PodList
+		if err := req.Client.List(req.Ctx, &pods, &client.ListOptions{
+			Namespace:     acornSystemNamespace,
+			LabelSelector: selector,
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, pod := range pods.Items {
+			// the IPs of completed pods can be handed out to other pods
+			if seen[pod.Name] || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				continue
+			}
+			seen[pod.Name] = true
+			result = append(result, pod)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// routerAuthentication returns the authentication representing the router pods of a project along with the reference
+// to it. When all the router pods are meshed their service account identities are used. Otherwise, the router forwards
+// traffic through klipper-lb and iptables, which bypasses linkerd-proxy, so the pod IPs are allowed instead. It returns
+// nil if the project has no router pods.
+func (h Handler) routerAuthentication(project string, pods []corev1.Pod, trustDomain string) (client.Object, *gatewayapiv1alpha2.PolicyTargetReference) {
+	if len(pods) == 0 {
+		return nil, nil
+	}
+
+	meshed := true
+	for _, pod := range pods {
+		if !isMeshed(pod) {
+			meshed = false
+			break
+		}
+	}
+
+	var obj client.Object
+	kind := "NetworkAuthentication"
+	if meshed {
+		kind = "MeshTLSAuthentication"
+		obj = &policyv1alpha1.MeshTLSAuthentication{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: project,
+				Name:      name.SafeConcatName(routerMeshTLSAuthenticationName, project),
+			},
+			Spec: h.meshTLSAuthenticationSpec(podServiceAccounts(pods), trustDomain),
+		}
+	} else {
+		var ips []string
+		for _, pod := range pods {
+			ips = append(ips, podIPs(pod)...)
+		}
+		networks := networksForAddresses(ips, h.aggregateNetworks)
+		if len(networks) == 0 {
+			return nil, nil
+		}
+
+		obj = &policyv1alpha1.NetworkAuthentication{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: project,
+				Name:      name.SafeConcatName(routerNetworkAuthenticationName, project),
+			},
+			Spec: policyv1alpha1.NetworkAuthenticationSpec{
+				Networks: networks,
+			},
+		}
+	}
+
+	namespace := gatewayapiv1alpha2.Namespace(project)
+	return obj, &gatewayapiv1alpha2.PolicyTargetReference{
+		Group:     gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
+		Kind:      gatewayapiv1alpha2.Kind(kind),
+		Name:      gatewayapiv1alpha2.ObjectName(obj.GetName()),
+		Namespace: &namespace,
+	}
+}
@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/acorn-io/baaah/pkg/apply"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	policyv1alpha1 "github.com/linkerd/linkerd2/controller/gen/apis/policy/v1alpha1"
+)
+
+const (
+	// projectFinalizer keeps a project namespace around until the policies created for it in other namespaces are removed
+	projectFinalizer = "acorn.io/linkerd-plugin"
+
+	// injectedAnnotation records that the inject annotation of a project was set by the plugin, so that it is only
+	// removed again if the plugin added it. Setting it to false keeps an inject annotation set by the team.
+	injectedAnnotation = "acorn.io/linkerd-injected"
+
+	cleanupRetryDelay = 5 * time.Second
+)
+
+// CleanupProject removes everything the plugin created for a namespace that is deleted or is no longer a project. The
+// policies of a project live in its app namespaces, so they can't be garbage collected through owner references.
+// Instead, a finalizer keeps the project namespace until the router has pruned all the objects it created for it,
+// which happens when the project handlers no longer produce objects for the namespace.
+func (h Handler) CleanupProject(req router.Request, resp router.Response) error {
+	if req.Object == nil {
+		return nil
+	}
+	namespace := req.Object.(*corev1.Namespace)
+
+	isProject := projectSelector.Matches(labels.Set(namespace.Labels))
+	if isProject && namespace.DeletionTimestamp.IsZero() {
+		// Only projects that the plugin creates objects for have to wait for their removal
+		createsObjects, err := createsProjectObjects(req, namespace)
+		if err != nil {
+			return err
+		}
+		if createsObjects == hasFinalizer(namespace) {
+			return nil
+		}
+		if createsObjects {
+			namespace.Finalizers = append(namespace.Finalizers, projectFinalizer)
+		} else {
+			removeFinalizer(namespace)
+		}
+		return req.Client.Update(req.Ctx, namespace)
+	}
+
+	changed := false
+	if !isProject && namespace.Annotations[injectedAnnotation] == "true" {
+		logrus.Infof("Removing linkerd annotations from namespace %v that is no longer a project", namespace.Name)
+		delete(namespace.Annotations, injectedAnnotation)
+		delete(namespace.Annotations, serviceMeshAnnotation)
+		if namespace.Annotations[defaultInboundPolicyAnnotation] == defaultInboundPolicyAudit {
+			delete(namespace.Annotations, defaultInboundPolicyAnnotation)
+		}
+		changed = true
+	}
+
+	if hasFinalizer(namespace) {
+		remaining, err := countProjectObjects(req, namespace)
+		if err != nil {
+			return err
+		}
+		if remaining > 0 {
+			// The objects are pruned once this request is saved, check again afterwards
+			logrus.Infof("Waiting for %d linkerd objects of project %v to be removed", remaining, namespace.Name)
+			if h.trigger != nil {
+				if err := h.trigger.Trigger(namespaceGVK, namespace.Name, cleanupRetryDelay); err != nil {
+					return err
+				}
+			}
+		} else {
+			removeFinalizer(namespace)
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+	return req.Client.Update(req.Ctx, namespace)
+}
+
+// createsProjectObjects checks if the plugin created objects for the project namespace. The objects are only saved
+// after the handlers of the project ran, so a project with apps that isn't excluded from isolation is expected to get
+// them as well.
+func createsProjectObjects(req router.Request, namespace *corev1.Namespace) (bool, error) {
+	remaining, err := countProjectObjects(req, namespace)
+	if err != nil || remaining > 0 {
+		return remaining > 0, err
+	}
+	if isolationMode(namespace) == isolationOff {
+		return false, nil
+	}
+
+	appNamespaces, err := listAppNamespaces(req, namespace.Name)
+	if err != nil {
+		return false, err
+	}
+	return len(appNamespaces) > 0, nil
+}
+
+// countProjectObjects returns how many of the linkerd policy objects that the router applied for the project namespace
+// still exist
+func countProjectObjects(req router.Request, namespace *corev1.Namespace) (int, error) {
+	labelSet, _, err := apply.GetLabelsAndAnnotations(req.Client.Scheme(), routerName, namespace)
+	if err != nil {
+		return 0, err
+	}
+	selector, err := apply.GetSelector(labelSet)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, list := range []client.ObjectList{
+		&policyv1alpha1.AuthorizationPolicyList{},
+		&policyv1alpha1.MeshTLSAuthenticationList{},
+		&policyv1alpha1.NetworkAuthenticationList{},
+		&networkingv1.NetworkPolicyList{},
+	} {
+		if err := req.Client.List(req.Ctx, list, &client.ListOptions{
+			LabelSelector: selector,
+		}); err != nil {
+			return 0, err
+		}
+		count += meta.LenList(list)
+	}
+	return count, nil
+}
+
+func hasFinalizer(namespace *corev1.Namespace) bool {
+	for _, finalizer := range namespace.Finalizers {
+		if finalizer == projectFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFinalizer(namespace *corev1.Namespace) {
+	var finalizers []string
+	for _, finalizer := range namespace.Finalizers {
+		if finalizer != projectFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	namespace.Finalizers = finalizers
+}
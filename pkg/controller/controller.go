@@ -2,29 +2,80 @@ package controller
 
 import (
 	"context"
+	"time"
 
 	"github.com/acorn-io/acorn-linkerd-plugin/pkg/scheme"
 	"github.com/acorn-io/baaah"
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// routerName is the name of the router, the objects the router applies are labeled with it
+const routerName = "linkerd-controller"
+
 type Options struct {
-	K8s kubernetes.Interface
+	K8s           kubernetes.Interface
+	APIExtensions apiextensionsclient.Interface
+	// Client is an uncached client for the migrations that run before the router starts
+	Client client.Client
+
+	DebugImage                string
+	DebugImagePullPolicy      string
+	DebugImagePullSecret      string
+	ShutdownSecurityContext   string
+	SidecarShutdown           string
+	SidecarShutdownTimeout    time.Duration
+	SidecarShutdownEscalation string
+	ClusterDomain             string
+	// ClusterDomainOverride uses ClusterDomain even if the trust domain of linkerd differs
+	ClusterDomainOverride bool
 
-	DebugImage    string
-	ClusterDomain string
+	IngressEndpoints        []IngressEndpoint
+	IngressEndpointSelector string
+	IngressDiscovery        bool
+	IngressAuthMode         string
 
-	IngressEndpointName      string
-	IngressEndpointNamespace string
+	AggregateNetworks bool
+	PerAppIdentities  bool
+	IdentityRefs      string
+	NetworkPolicies   bool
 }
 
 func Start(ctx context.Context, opt Options) error {
-	router, err := baaah.DefaultRouter("linkerd-controller", scheme.Scheme)
+	router, err := baaah.DefaultRouter(routerName, scheme.Scheme)
+	if err != nil {
+		return err
+	}
+
+	opt.IngressEndpoints, err = ResolveIngressAuthModes(ctx, opt.K8s, opt.IngressAuthMode, opt.IngressEndpoints)
+	if err != nil {
+		return err
+	}
+
+	opt.IdentityRefs, err = ResolveIdentityRefs(ctx, opt.APIExtensions, opt.IdentityRefs)
+	if err != nil {
+		return err
+	}
+
+	opt.SidecarShutdown, err = ResolveSidecarShutdown(ctx, opt.K8s, opt.SidecarShutdown)
 	if err != nil {
 		return err
 	}
 
-	if err := RegisterRoutes(router, opt.K8s, opt.DebugImage, opt.ClusterDomain, opt.IngressEndpointName, opt.IngressEndpointNamespace); err != nil {
+	if err := ValidateSidecarShutdownEscalation(opt.SidecarShutdownEscalation); err != nil {
+		return err
+	}
+
+	if err := ValidatePullPolicy(opt.DebugImagePullPolicy); err != nil {
+		return err
+	}
+
+	if opt.Client != nil {
+		migrate(ctx, opt.Client)
+	}
+
+	if err := RegisterRoutes(router, opt); err != nil {
 		return err
 	}
 
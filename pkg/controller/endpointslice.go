@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"sort"
+
+	"github.com/acorn-io/baaah/pkg/router"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// listEndpointSlices returns the EndpointSlices of the service, sorted by name. The slices are listed by namespace and
+// filtered by their service name label afterwards, so that the deletion of a slice also triggers the caller again.
+func listEndpointSlices(req router.Request, namespace, serviceName string) ([]discoveryv1.EndpointSlice, error) {
+	var slices discoveryv1.EndpointSliceList
+	if err := req.Client.List(req.Ctx, &slices, &client.ListOptions{
+		Namespace: namespace,
+	}); err != nil {
+		return nil, err
+	}
+
+	var result []discoveryv1.EndpointSlice
+	for _, slice := range slices.Items {
+		if slice.Labels[discoveryv1.LabelServiceName] == serviceName {
+			result = append(result, slice)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// isActiveEndpoint checks if traffic can come from the endpoint. Endpoints are active when they are ready, or when they
+// are terminating but still serving, since those are draining connections that are still in flight.
+func isActiveEndpoint(endpoint discoveryv1.Endpoint) bool {
+	conditions := endpoint.Conditions
+	// a nil ready condition means the state is unknown, which consumers should interpret as ready
+	if conditions.Ready == nil || *conditions.Ready {
+		return true
+	}
+	return conditions.Terminating != nil && *conditions.Terminating &&
+		(conditions.Serving == nil || *conditions.Serving)
+}
+
+// endpointSliceAddresses merges the addresses of the active endpoints across all the slices. Addresses that appear in
+// more than one slice are only returned once, and the result is sorted so the generated objects are stable.
+func endpointSliceAddresses(slices []discoveryv1.EndpointSlice) []string {
+	seen := map[string]bool{}
+	var result []string
+	for _, slice := range slices {
+		for _, endpoint := range slice.Endpoints {
+			if !isActiveEndpoint(endpoint) {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				if seen[address] {
+					continue
+				}
+				seen[address] = true
+				result = append(result, address)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// endpointSlicePods returns the pods behind the endpoints of all the slices, sorted by namespace and name. Pods that are
+// not ready are included, since their identity doesn't change when they become ready.
+func endpointSlicePods(slices []discoveryv1.EndpointSlice) []corev1.ObjectReference {
+	seen := map[string]bool{}
+	var result []corev1.ObjectReference
+	for _, slice := range slices {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" {
+				continue
+			}
+			key := endpoint.TargetRef.Namespace + "/" + endpoint.TargetRef.Name
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			result = append(result, *endpoint.TargetRef)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Namespace == result[j].Namespace {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Namespace < result[j].Namespace
+	})
+	return result
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/acorn-io/baaah/pkg/name"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	policyv1alpha1 "github.com/linkerd/linkerd2/controller/gen/apis/policy/v1alpha1"
+	serverv1beta1 "github.com/linkerd/linkerd2/controller/gen/apis/server/v1beta1"
+)
+
+const (
+	// allowedProjectsAnnotation can be set on a project namespace or on an acorn managed service. It contains a comma
+	// separated list of other projects whose apps are allowed to reach the servers of the project (or service).
+	allowedProjectsAnnotation = "acorn.io/linkerd-allowed-projects"
+)
+
+// parseAllowedProjects returns the projects listed in the allowed projects annotation, excluding the owning project.
+func parseAllowedProjects(annotations map[string]string, project string) []string {
+	var result []string
+	for _, p := range strings.Split(annotations[allowedProjectsAnnotation], ",") {
+		p = strings.TrimSpace(p)
+		if p == "" || p == project {
+			continue
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// allowedProjectsForServer returns the sorted union of the projects granted on the project namespace and the projects
+// granted on the service that the server was created for.
+func allowedProjectsForServer(req router.Request, projectNamespace *corev1.Namespace, server serverv1beta1.Server) ([]string, error) {
+	projects := map[string]bool{}
+	for _, p := range parseAllowedProjects(projectNamespace.Annotations, projectNamespace.Name) {
+		projects[p] = true
+	}
+
+	if serviceName := server.Labels[serviceNameLabel]; serviceName != "" {
+		var service corev1.Service
+		if err := req.Client.Get(req.Ctx, client.ObjectKey{
+			Namespace: server.Namespace,
+			Name:      serviceName,
+		}, &service); err != nil && !apierrors.IsNotFound(err) {
+			return nil, err
+		} else if err == nil {
+			for _, p := range parseAllowedProjects(service.Annotations, projectNamespace.Name) {
+				projects[p] = true
+			}
+		}
+	}
+
+	result := make([]string, 0, len(projects))
+	for p := range projects {
+		result = append(result, p)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// grantMeshTLSAuthentication builds the MeshTLSAuthentication in the project namespace that represents all the service
+// account identities of a granted project. It returns nil if the granted project is not an acorn project or has no apps.
+func (h Handler) grantMeshTLSAuthentication(req router.Request, project, grantedProject, trustDomain string) (*policyv1alpha1.MeshTLSAuthentication, error) {
+	var grantedNamespace corev1.Namespace
+	if err := req.Client.Get(req.Ctx, client.ObjectKey{Name: grantedProject}, &grantedNamespace); apierrors.IsNotFound(err) {
+		logrus.Debugf("Ignoring grant from project %v to unknown project %v", project, grantedProject)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !projectSelector.Matches(labels.Set(grantedNamespace.Labels)) {
+		logrus.Debugf("Ignoring grant from project %v to namespace %v that is not a project", project, grantedProject)
+		return nil, nil
+	}
+
+	appNamespaces, err := listAppNamespaces(req, grantedProject)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceAccounts, err := h.identities(req, appNamespaces)
+	if err != nil {
+		return nil, err
+	}
+	if len(serviceAccounts) == 0 {
+		return nil, nil
+	}
+
+	return &policyv1alpha1.MeshTLSAuthentication{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: project,
+			Name:      grantMeshTLSAuthenticationName(grantedProject),
+		},
+		Spec: h.meshTLSAuthenticationSpec(serviceAccounts, trustDomain),
+	}, nil
+}
+
+func grantMeshTLSAuthenticationName(grantedProject string) string {
+	return name.SafeConcatName("mesh-authn-grant", grantedProject)
+}
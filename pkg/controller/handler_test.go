@@ -1,13 +1,40 @@
 package controller
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/acorn-io/acorn-linkerd-plugin/pkg/scheme"
+	"github.com/acorn-io/baaah/pkg/apply"
+	"github.com/acorn-io/baaah/pkg/router"
 	"github.com/acorn-io/baaah/pkg/router/tester"
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	k8sversion "k8s.io/apimachinery/pkg/version"
+	fakediscovery "k8s.io/client-go/discovery/fake"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	gatewayapiv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	policyv1alpha1 "github.com/linkerd/linkerd2/controller/gen/apis/policy/v1alpha1"
+	serverv1beta1 "github.com/linkerd/linkerd2/controller/gen/apis/server/v1beta1"
 )
 
 func TestHandler_AddAnnotations(t *testing.T) {
@@ -18,11 +45,73 @@ func TestHandler_AddAnnotations(t *testing.T) {
 
 	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
 
-	if err := AddAnnotations(req, nil); err != nil {
+	if err := (Handler{}).AddAnnotations(req, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "enabled", input.GetAnnotations()[serviceMeshAnnotation])
+}
+
+func TestHandler_AddAnnotations_Audit(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/annotations-audit")
+	if err != nil {
 		t.Fatal(err)
 	}
 
+	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+
+	if err := (Handler{}).AddAnnotations(req, nil); err != nil {
+		t.Fatal(err)
+	}
 	assert.Equal(t, "enabled", input.GetAnnotations()[serviceMeshAnnotation])
+	// audit isolation is no longer supported, the default inbound policy set for it before is removed
+	assert.NotContains(t, input.GetAnnotations(), defaultInboundPolicyAnnotation)
+	assert.Equal(t, isolationStrict, isolationMode(input.(*corev1.Namespace)))
+}
+
+func TestHandler_AddAnnotations_Migration(t *testing.T) {
+	project := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "acorn",
+			Labels:      map[string]string{"acorn.io/project": "true"},
+			Annotations: map[string]string{serviceMeshAnnotation: "enabled"},
+		},
+	}
+
+	// previous versions added the inject annotation without recording it
+	if err := (Handler{}).AddAnnotations(tester.NewRequest(t, scheme.Scheme, project), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "true", project.Annotations[injectedAnnotation])
+
+	// an inject annotation that the team marked as their own is left alone
+	project.Annotations[injectedAnnotation] = "false"
+	if err := (Handler{}).AddAnnotations(tester.NewRequest(t, scheme.Scheme, project), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "false", project.Annotations[injectedAnnotation])
+	assert.Equal(t, "enabled", project.Annotations[serviceMeshAnnotation])
+}
+
+func TestHandler_AddAnnotations_OptOut(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/annotations-opt-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+
+	if err := (Handler{}).AddAnnotations(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, input.GetAnnotations(), serviceMeshAnnotation)
+
+	// an injection that was disabled by the team is kept
+	input.SetAnnotations(map[string]string{serviceMeshAnnotation: "disabled"})
+	if err := (Handler{}).AddAnnotations(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "disabled", input.GetAnnotations()[serviceMeshAnnotation])
 }
 
 func TestHandler_KillLinkerdSidecar(t *testing.T) {
@@ -32,13 +121,16 @@ func TestHandler_KillLinkerdSidecar(t *testing.T) {
 	}
 
 	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+	resp := &router.ResponseWrapper{}
 
 	h := Handler{
-		client:     fake.NewSimpleClientset(input),
-		debugImage: "foo",
+		client:                 fake.NewSimpleClientset(input),
+		debugImage:             "foo",
+		sidecarShutdownTimeout: time.Minute,
+		recorder:               record.NewFakeRecorder(10),
 	}
 
-	if err := h.KillLinkerdSidecar(req, nil); err != nil {
+	if err := h.KillLinkerdSidecar(req, resp); err != nil {
 		t.Fatal(err)
 	}
 
@@ -56,52 +148,1378 @@ func TestHandler_KillLinkerdSidecar(t *testing.T) {
 			},
 		},
 	}
-	assert.Equal(t, expected, input.(*corev1.Pod).Spec.EphemeralContainers[0])
+	pod := clientPod(t, h, input)
+	assert.Equal(t, expected, pod.Spec.EphemeralContainers[0])
+	assert.Empty(t, input.(*corev1.Pod).Spec.EphemeralContainers)
+	assert.Equal(t, sidecarShutdownInitialBackoff, resp.Delay)
+
+	progress := sidecarShutdownProgressOf(pod)
+	assert.Equal(t, 1, progress.Attempts)
+	assert.False(t, progress.Started.IsZero())
 }
 
-func TestHandler_AddLinkerdServer(t *testing.T) {
-	tester.DefaultTest(t, scheme.Scheme, "testdata/server", AddLinkerdServer)
+func TestHandler_KillLinkerdSidecar_Terminated(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/killsidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := input.(*corev1.Pod)
+	for i := range pod.Status.ContainerStatuses {
+		pod.Status.ContainerStatuses[i].State = corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}
+	}
+
+	h := Handler{
+		client:     fake.NewSimpleClientset(input),
+		debugImage: "foo",
+	}
+	if err := h.KillLinkerdSidecar(tester.NewRequest(t, harness.Scheme, input, harness.Existing...), &router.ResponseWrapper{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, clientPod(t, h, pod).Spec.EphemeralContainers)
 }
 
-func TestHandler_AddAuthorizationPolicy(t *testing.T) {
+func TestResolveSidecarShutdown(t *testing.T) {
+	linkerdConfig := func(values string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: linkerdNamespace, Name: linkerdConfigName},
+			Data:       map[string]string{"values": values},
+		}
+	}
+
+	for _, test := range []struct {
+		name          string
+		strategy      string
+		serverVersion string
+		configMap     *corev1.ConfigMap
+		expected      string
+	}{
+		{name: "explicit", strategy: SidecarShutdownEphemeralContainer, serverVersion: "v1.29.1", configMap: linkerdConfig("proxy:\n  nativeSidecar: false\n"), expected: SidecarShutdownEphemeralContainer},
+		{name: "native", strategy: SidecarShutdownAuto, serverVersion: "v1.29.1+k3s1", configMap: linkerdConfig("proxy:\n  nativeSidecar: false\n"), expected: SidecarShutdownNativeSidecar},
+		{name: "old kubernetes", strategy: SidecarShutdownAuto, serverVersion: "v1.28.5", configMap: linkerdConfig("proxy:\n  nativeSidecar: false\n"), expected: SidecarShutdownEphemeralContainer},
+		{name: "old linkerd", strategy: SidecarShutdownAuto, serverVersion: "v1.29.1", configMap: linkerdConfig("proxy:\n  logLevel: info\n"), expected: SidecarShutdownEphemeralContainer},
+		{name: "no linkerd config", strategy: SidecarShutdownAuto, serverVersion: "v1.29.1", expected: SidecarShutdownEphemeralContainer},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var objects []runtime.Object
+			if test.configMap != nil {
+				objects = append(objects, test.configMap)
+			}
+			k8s := fake.NewSimpleClientset(objects...)
+			k8s.Discovery().(*fakediscovery.FakeDiscovery).FakedServerVersion = &k8sversion.Info{GitVersion: test.serverVersion}
+
+			strategy, err := ResolveSidecarShutdown(context.Background(), k8s, test.strategy)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, strategy)
+		})
+	}
+
+	_, err := ResolveSidecarShutdown(context.Background(), fake.NewSimpleClientset(), "exec")
+	assert.Error(t, err)
+}
+
+func TestHandler_SidecarShutdownMethods(t *testing.T) {
+	for strategy, expected := range map[string][]string{
+		SidecarShutdownEphemeralContainer: {"an ephemeral container"},
+		// proxies that don't run as native sidecar are shut down from an ephemeral container as well
+		SidecarShutdownNativeSidecar: {"an ephemeral container"},
+	} {
+		var methods []string
+		for _, method := range (Handler{sidecarShutdown: strategy}).sidecarShutdownMethods() {
+			methods = append(methods, method.String())
+		}
+		assert.Equal(t, expected, methods, strategy)
+	}
+}
+
+func TestHandler_AddAnnotations_NativeSidecar(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/annotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+
+	h := Handler{sidecarShutdown: SidecarShutdownNativeSidecar}
+	if err := h.AddAnnotations(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "true", input.GetAnnotations()[nativeSidecarAnnotation])
+
+	h.sidecarShutdown = SidecarShutdownEphemeralContainer
+	if err := h.AddAnnotations(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, input.GetAnnotations(), nativeSidecarAnnotation)
+	assert.NotContains(t, input.GetAnnotations(), nativeSidecarSetAnnotation)
+}
+
+func TestHandler_KillLinkerdSidecar_NativeSidecar(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/killsidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := input.(*corev1.Pod)
+	// a native sidecar is an init container
+	pod.Spec.InitContainers = pod.Spec.Containers[1:]
+	pod.Spec.Containers = pod.Spec.Containers[:1]
+	pod.Status.InitContainerStatuses = pod.Status.ContainerStatuses[1:]
+	pod.Status.ContainerStatuses = pod.Status.ContainerStatuses[:1]
+
 	h := Handler{
-		clusterDomain:            "cluster.local",
-		ingressEndpointNamespace: "kube-system",
+		client:          fake.NewSimpleClientset(input),
+		debugImage:      "foo",
+		sidecarShutdown: SidecarShutdownNativeSidecar,
+		recorder:        record.NewFakeRecorder(10),
 	}
-	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy", h.AddAuthorizationPolicy)
+	if err := h.KillLinkerdSidecar(tester.NewRequest(t, harness.Scheme, input, harness.Existing...), &router.ResponseWrapper{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, clientPod(t, h, pod).Spec.EphemeralContainers)
 }
 
-func TestHandler_AddAuthorizationPolicy_Ingress(t *testing.T) {
+func TestHandler_KillLinkerdSidecar_ProxyConfiguration(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		annotations map[string]string
+		proxy       corev1.Container
+		port        string
+	}{
+		{name: "annotation", annotations: map[string]string{proxyAdminPortAnnotation: "9991"}, proxy: corev1.Container{Name: "linkerd-proxy"}, port: "9991"},
+		{name: "env", proxy: corev1.Container{Name: "linkerd-proxy", Env: []corev1.EnvVar{{Name: proxyAdminListenAddrEnv, Value: "[::]:9992"}}}, port: "9992"},
+		{name: "env over annotation", annotations: map[string]string{proxyAdminPortAnnotation: "9991"}, proxy: corev1.Container{Name: "linkerd-proxy", Env: []corev1.EnvVar{{Name: proxyAdminListenAddrEnv, Value: "0.0.0.0:9992"}}}, port: "9992"},
+		{name: "renamed", proxy: corev1.Container{Name: "proxy", Env: []corev1.EnvVar{{Name: proxyAdminListenAddrEnv, Value: "0.0.0.0:4191"}}}, port: "4191"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "test",
+					Name:        "test",
+					Labels:      map[string]string{jobLabel: "foo"},
+					Annotations: test.annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "foo"}, test.proxy},
+				},
+				Status: corev1.PodStatus{
+					ContainerStatuses: []corev1.ContainerStatus{
+						{Name: "foo", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}},
+						{Name: test.proxy.Name, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+					},
+				},
+			}
+
+			h := Handler{
+				client:                 fake.NewSimpleClientset(pod),
+				debugImage:             "foo",
+				sidecarShutdownTimeout: time.Minute,
+				recorder:               record.NewFakeRecorder(10),
+			}
+			if err := h.KillLinkerdSidecar(tester.NewRequest(t, scheme.Scheme, pod), &router.ResponseWrapper{}); err != nil {
+				t.Fatal(err)
+			}
+
+			containers := clientPod(t, h, pod).Spec.EphemeralContainers
+			if assert.Len(t, containers, 1) {
+				assert.Equal(t, test.proxy.Name, containers[0].TargetContainerName)
+				assert.Equal(t, "http://localhost:"+test.port+"/shutdown", containers[0].Command[3])
+			}
+		})
+	}
+}
+
+// sidecarShutdownPod returns the pod of the killsidecar testdata with the given sidecar shutdown progress
+func sidecarShutdownPod(t *testing.T, progress sidecarShutdownProgress) *corev1.Pod {
+	_, input, err := tester.FromDir(scheme.Scheme, "testdata/killsidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := input.(*corev1.Pod)
+	pod.Annotations = map[string]string{sidecarShutdownAnnotation: string(value)}
+	return pod
+}
+
+func TestHandler_KillLinkerdSidecar_Retry(t *testing.T) {
+	pod := sidecarShutdownPod(t, sidecarShutdownProgress{
+		Attempts: 1,
+		Started:  metav1.NewTime(time.Now().Add(-30 * time.Second)),
+		Last:     metav1.NewTime(time.Now().Add(-30 * time.Second)),
+	})
+	pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{
+		{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: shutdownSidecarContainerName}},
+	}
+	pod.Status.EphemeralContainerStatuses = []corev1.ContainerStatus{
+		{
+			Name: shutdownSidecarContainerName,
+			State: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{ExitCode: 7, Reason: "Error"},
+			},
+		},
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	resp := &router.ResponseWrapper{}
 	h := Handler{
-		clusterDomain:            "cluster.local",
-		ingressEndpointNamespace: "kube-system",
+		client:                 fake.NewSimpleClientset(pod),
+		debugImage:             "foo",
+		sidecarShutdownTimeout: 5 * time.Minute,
+		recorder:               recorder,
 	}
-	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-with-ingress", h.AddAuthorizationPolicy)
+	if err := h.KillLinkerdSidecar(tester.NewRequest(t, scheme.Scheme, pod), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	containers := clientPod(t, h, pod).Spec.EphemeralContainers
+	if assert.Len(t, containers, 2) {
+		assert.Equal(t, "shutdown-sidecar-2", containers[1].Name)
+	}
+	assert.Equal(t, 2*sidecarShutdownInitialBackoff, resp.Delay)
+	assert.Contains(t, <-recorder.Events, "Warning SidecarShutdownFailed Attempt 1 to shut down the linkerd proxy failed: container shutdown-sidecar exited with 7: Error")
+	assert.Contains(t, <-recorder.Events, "Normal SidecarShutdown")
 }
 
-func TestHandler_NoAppNamespace(t *testing.T) {
+func TestHandler_KillLinkerdSidecar_PendingShutdownContainer(t *testing.T) {
+	for _, state := range []corev1.ContainerState{
+		{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}},
+		{Running: &corev1.ContainerStateRunning{}},
+	} {
+		pod := sidecarShutdownPod(t, sidecarShutdownProgress{
+			Attempts: 1,
+			Started:  metav1.NewTime(time.Now().Add(-30 * time.Second)),
+			Last:     metav1.NewTime(time.Now().Add(-30 * time.Second)),
+		})
+		pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{
+			{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: shutdownSidecarContainerName}},
+		}
+		pod.Status.EphemeralContainerStatuses = []corev1.ContainerStatus{
+			{Name: shutdownSidecarContainerName, State: state},
+		}
+
+		h := Handler{
+			client:                 fake.NewSimpleClientset(pod),
+			debugImage:             "foo",
+			sidecarShutdownTimeout: 5 * time.Minute,
+			recorder:               record.NewFakeRecorder(10),
+		}
+		if err := h.KillLinkerdSidecar(tester.NewRequest(t, scheme.Scheme, pod), &router.ResponseWrapper{}); err != nil {
+			t.Fatal(err)
+		}
+
+		// another container would only wait for the same image or proxy
+		assert.Len(t, clientPod(t, h, pod).Spec.EphemeralContainers, 1)
+	}
+}
+
+func TestHandler_KillLinkerdSidecar_MaxShutdownContainers(t *testing.T) {
+	pod := sidecarShutdownPod(t, sidecarShutdownProgress{
+		Attempts: maxShutdownSidecarContainers,
+		Started:  metav1.NewTime(time.Now().Add(-4 * time.Minute)),
+		Last:     metav1.NewTime(time.Now().Add(-4 * time.Minute)),
+	})
+	for i := 0; i < maxShutdownSidecarContainers; i++ {
+		pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+			EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: ephemeralShutdownContainerName(pod)},
+		})
+		pod.Status.EphemeralContainerStatuses = append(pod.Status.EphemeralContainerStatuses, corev1.ContainerStatus{
+			Name:  pod.Spec.EphemeralContainers[i].Name,
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 7}},
+		})
+	}
+
+	recorder := record.NewFakeRecorder(10)
 	h := Handler{
-		clusterDomain: "cluster.local",
+		client:                 fake.NewSimpleClientset(pod),
+		debugImage:             "foo",
+		sidecarShutdownTimeout: 5 * time.Minute,
+		recorder:               recorder,
 	}
-	tester.DefaultTest(t, scheme.Scheme, "testdata/no-app-namespace", h.AddAuthorizationPolicy)
+	if err := h.KillLinkerdSidecar(tester.NewRequest(t, scheme.Scheme, pod), &router.ResponseWrapper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, clientPod(t, h, pod).Spec.EphemeralContainers, maxShutdownSidecarContainers)
+	<-recorder.Events
+	assert.Contains(t, <-recorder.Events, "Warning SidecarShutdownFailed Failed to shut down the linkerd proxy through an ephemeral container: pod test/test already has 5 shutdown containers")
 }
 
-func TestHandler_ConfigureNetworkAuthorizationForIngress(t *testing.T) {
-	h := Handler{}
-	tester.DefaultTest(t, scheme.Scheme, "testdata/network-authentication", h.ConfigureNetworkAuthorizationForIngress)
+// clientPod returns the pod as stored by the client of the handler
+func clientPod(t *testing.T, h Handler, pod client.Object) *corev1.Pod {
+	result, err := h.client.CoreV1().Pods(pod.GetNamespace()).Get(context.Background(), pod.GetName(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
 }
 
-func TestHandler_ConfigureNetworkPolicyForBuildServer(t *testing.T) {
+func TestHandler_KillLinkerdSidecar_Backoff(t *testing.T) {
+	pod := sidecarShutdownPod(t, sidecarShutdownProgress{
+		Attempts: 2,
+		Started:  metav1.NewTime(time.Now().Add(-time.Minute)),
+		Last:     metav1.NewTime(time.Now()),
+	})
+
+	resp := &router.ResponseWrapper{}
 	h := Handler{
-		ingressEndpointNamespace: "kube-system",
+		client:                 fake.NewSimpleClientset(pod),
+		debugImage:             "foo",
+		sidecarShutdownTimeout: 5 * time.Minute,
+		recorder:               record.NewFakeRecorder(10),
 	}
-	tester.DefaultTest(t, scheme.Scheme, "testdata/builder", h.ConfigureNetworkPolicyForBuildServer)
+	if err := h.KillLinkerdSidecar(tester.NewRequest(t, scheme.Scheme, pod), resp); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, clientPod(t, h, pod).Spec.EphemeralContainers)
+	assert.Greater(t, resp.Delay, sidecarShutdownInitialBackoff)
+	assert.LessOrEqual(t, resp.Delay, 2*sidecarShutdownInitialBackoff)
 }
 
-func TestHandler_AddAuthorizationPolicy_Router(t *testing.T) {
+func TestHandler_KillLinkerdSidecar_EscalateFailJob(t *testing.T) {
+	pod := sidecarShutdownPod(t, sidecarShutdownProgress{
+		Attempts: 6,
+		Started:  metav1.NewTime(time.Now().Add(-10 * time.Minute)),
+		Last:     metav1.NewTime(time.Now().Add(-time.Minute)),
+	})
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: "foo"},
+		Status:     batchv1.JobStatus{StartTime: &metav1.Time{Time: time.Now().Add(-15 * time.Minute)}},
+	}
+	pod.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(job, batchv1.SchemeGroupVersion.WithKind("Job"))}
+
+	recorder := record.NewFakeRecorder(10)
 	h := Handler{
-		clusterDomain:            "cluster.local",
-		ingressEndpointNamespace: "kube-system",
+		client:                    fake.NewSimpleClientset(pod, job),
+		sidecarShutdownTimeout:    5 * time.Minute,
+		sidecarShutdownEscalation: SidecarShutdownEscalationFailJob,
+		recorder:                  recorder,
 	}
-	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-with-router-service", h.AddAuthorizationPolicy)
+	if err := h.KillLinkerdSidecar(tester.NewRequest(t, scheme.Scheme, pod), &router.ResponseWrapper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := h.client.BatchV1().Jobs(pod.Namespace).Get(context.Background(), "foo", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, job.Spec.ActiveDeadlineSeconds) {
+		assert.InDelta(t, 15*60, *job.Spec.ActiveDeadlineSeconds, 5)
+	}
+	assert.Contains(t, <-recorder.Events, "Warning SidecarShutdownEscalated The linkerd proxy is still running after 6 attempts to shut it down, failing job foo")
+
+	updated, err := h.client.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, sidecarShutdownProgressOf(updated).Escalated)
+	assert.Empty(t, updated.Spec.EphemeralContainers)
+}
+
+func TestHandler_KillLinkerdSidecar_EscalateDeletePod(t *testing.T) {
+	pod := sidecarShutdownPod(t, sidecarShutdownProgress{
+		Attempts: 6,
+		Started:  metav1.NewTime(time.Now().Add(-10 * time.Minute)),
+		Last:     metav1.NewTime(time.Now().Add(-time.Minute)),
+	})
+
+	h := Handler{
+		client:                    fake.NewSimpleClientset(pod),
+		sidecarShutdownTimeout:    5 * time.Minute,
+		sidecarShutdownEscalation: SidecarShutdownEscalationDeletePod,
+		recorder:                  record.NewFakeRecorder(10),
+	}
+	if err := h.KillLinkerdSidecar(tester.NewRequest(t, scheme.Scheme, pod), &router.ResponseWrapper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := h.client.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+}
+
+func TestSidecarShutdownBackoff(t *testing.T) {
+	assert.Equal(t, 10*time.Second, sidecarShutdownBackoff(1))
+	assert.Equal(t, 20*time.Second, sidecarShutdownBackoff(2))
+	assert.Equal(t, 80*time.Second, sidecarShutdownBackoff(4))
+	assert.Equal(t, 2*time.Minute, sidecarShutdownBackoff(5))
+	assert.Equal(t, 2*time.Minute, sidecarShutdownBackoff(20))
+}
+
+func TestValidateSidecarShutdownEscalation(t *testing.T) {
+	assert.NoError(t, ValidateSidecarShutdownEscalation(SidecarShutdownEscalationFailJob))
+	assert.Error(t, ValidateSidecarShutdownEscalation("restart"))
+}
+
+func TestHandler_KillLinkerdSidecar_ShutdownContainer(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/killsidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := input.(*corev1.Pod)
+	pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "registry"}}
+
+	// the handler is built from the options, so that the flags reach the shutdown container
+	h, err := newHandler(Options{
+		K8s:                    fake.NewSimpleClientset(input),
+		DebugImage:             "foo",
+		DebugImagePullPolicy:   string(corev1.PullIfNotPresent),
+		DebugImagePullSecret:   "registry",
+		SidecarShutdownTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.recorder = record.NewFakeRecorder(10)
+	if err := h.KillLinkerdSidecar(tester.NewRequest(t, harness.Scheme, input, harness.Existing...), &router.ResponseWrapper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if containers := clientPod(t, h, pod).Spec.EphemeralContainers; assert.Len(t, containers, 1) {
+		container := containers[0]
+		assert.Equal(t, corev1.PullIfNotPresent, container.ImagePullPolicy)
+		assert.Equal(t, restrictedSecurityContext(), container.SecurityContext)
+	}
+}
+
+func TestHandler_KillLinkerdSidecar_MissingPullSecret(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/killsidecar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := input.(*corev1.Pod)
+
+	recorder := record.NewFakeRecorder(10)
+	h, err := newHandler(Options{
+		K8s:                    fake.NewSimpleClientset(input),
+		DebugImage:             "foo",
+		DebugImagePullSecret:   "registry",
+		SidecarShutdownTimeout: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.recorder = recorder
+	if err := h.KillLinkerdSidecar(tester.NewRequest(t, harness.Scheme, input, harness.Existing...), &router.ResponseWrapper{}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, clientPod(t, h, pod).Spec.EphemeralContainers)
+	assert.Contains(t, <-recorder.Events, "Warning SidecarShutdownFailed Failed to shut down the linkerd proxy through an ephemeral container: pod test/test doesn't have the image pull secret registry")
+}
+
+func TestParseShutdownSecurityContext(t *testing.T) {
+	securityContext, err := ParseShutdownSecurityContext(`{"runAsUser": 1000, "runAsNonRoot": true}`)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1000), *securityContext.RunAsUser)
+		assert.True(t, *securityContext.RunAsNonRoot)
+		assert.Nil(t, securityContext.Capabilities)
+	}
+
+	_, err = ParseShutdownSecurityContext("runAsUser: 1000")
+	assert.Error(t, err)
+}
+
+func TestValidatePullPolicy(t *testing.T) {
+	assert.NoError(t, ValidatePullPolicy("IfNotPresent"))
+	assert.Error(t, ValidatePullPolicy("Sometimes"))
+}
+
+func TestValidateSidecarShutdown(t *testing.T) {
+	assert.NoError(t, ValidateSidecarShutdown(SidecarShutdownEphemeralContainer))
+	assert.NoError(t, ValidateSidecarShutdown(SidecarShutdownNativeSidecar))
+	assert.Error(t, ValidateSidecarShutdown("exec"))
+}
+
+func TestHandler_AddLinkerdServer(t *testing.T) {
+	tester.DefaultTest(t, scheme.Scheme, "testdata/server", AddLinkerdServer)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	appProtocol := func(protocol string) *string {
+		return &protocol
+	}
+	service := &corev1.Service{}
+	// acorn sets the generic HTTP app protocol on every HTTP port, which is left to the protocol detection of linkerd
+	assert.Equal(t, proxyProtocolUnknown, proxyProtocol(service, corev1.ServicePort{Name: "80", Port: 80, AppProtocol: appProtocol("HTTP")}))
+	assert.Equal(t, proxyProtocolUnknown, proxyProtocol(service, corev1.ServicePort{Name: "http-web", Port: 8080}))
+	assert.Equal(t, proxyProtocolGRPC, proxyProtocol(service, corev1.ServicePort{Name: "grpc", Port: 9090, AppProtocol: appProtocol("HTTP")}))
+	assert.Equal(t, proxyProtocolHTTP1, proxyProtocol(service, corev1.ServicePort{Name: "80", Port: 80, AppProtocol: appProtocol("HTTP/1.1")}))
+	assert.Equal(t, proxyProtocolHTTP1, proxyProtocol(service, corev1.ServicePort{Name: "http1-web", Port: 8080}))
+	assert.Equal(t, proxyProtocolHTTP2, proxyProtocol(service, corev1.ServicePort{Name: "80", Port: 80, AppProtocol: appProtocol("kubernetes.io/h2c")}))
+	assert.Equal(t, proxyProtocolGRPC, proxyProtocol(service, corev1.ServicePort{Name: "grpc-api", Port: 9090}))
+	assert.Equal(t, proxyProtocolOpaque, proxyProtocol(service, corev1.ServicePort{Name: "mysql", Port: 3306}))
+	assert.Equal(t, proxyProtocolTLS, proxyProtocol(service, corev1.ServicePort{Name: "https", Port: 443}))
+	// unknown protocols are left to the protocol detection of linkerd
+	assert.Equal(t, "", proxyProtocol(service, corev1.ServicePort{Name: "3000", Port: 3000, AppProtocol: appProtocol("TCP")}))
+
+	service.Annotations = map[string]string{proxyProtocolAnnotation: "opaque, 80=HTTP/2, web=gRPC, 443=invalid"}
+	assert.Equal(t, proxyProtocolHTTP2, proxyProtocol(service, corev1.ServicePort{Name: "http", Port: 80, AppProtocol: appProtocol("HTTP")}))
+	assert.Equal(t, proxyProtocolGRPC, proxyProtocol(service, corev1.ServicePort{Name: "web", Port: 8080}))
+	assert.Equal(t, proxyProtocolOpaque, proxyProtocol(service, corev1.ServicePort{Name: "https", Port: 443}))
+	assert.Equal(t, proxyProtocolOpaque, proxyProtocol(service, corev1.ServicePort{Name: "3306", Port: 3306}))
+}
+
+// newClientRequest returns a request backed by a fake client, for handlers that patch objects, which the tester client
+// doesn't support
+func newClientRequest(obj client.Object, existing ...client.Object) router.Request {
+	return router.Request{
+		Client: crfake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(append(existing, obj)...).Build(),
+		Object: obj,
+		Ctx:    context.Background(),
+	}
+}
+
+func TestHandler_AddOpaquePortsToService(t *testing.T) {
+	tcp := "TCP"
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo1", Name: "db"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "80", Port: 80},
+				{Name: "3306", Port: 3306},
+				{Name: "9000", Port: 9000, AppProtocol: &tcp},
+			},
+		},
+	}
+	// the annotations are patched, the service of the request is left as is
+	addOpaquePorts := func(service *corev1.Service) *corev1.Service {
+		req := newClientRequest(service.DeepCopy())
+		if err := AddOpaquePortsToService(req, nil); err != nil {
+			t.Fatal(err)
+		}
+		var result corev1.Service
+		if err := req.Client.Get(req.Ctx, client.ObjectKeyFromObject(service), &result); err != nil {
+			t.Fatal(err)
+		}
+		return &result
+	}
+
+	service = addOpaquePorts(service)
+	assert.Equal(t, "3306,9000", service.Annotations[opaquePortsAnnotation])
+
+	// a proxy protocol set explicitly wins over the well known port
+	service.Annotations[proxyProtocolAnnotation] = "3306=TLS"
+	service = addOpaquePorts(service)
+	assert.Equal(t, "9000", service.Annotations[opaquePortsAnnotation])
+
+	service.Spec.Ports = service.Spec.Ports[:1]
+	service = addOpaquePorts(service)
+	assert.NotContains(t, service.Annotations, opaquePortsAnnotation)
+	assert.NotContains(t, service.Annotations, opaquePortsSetAnnotation)
+
+	// opaque ports that weren't set by the plugin are kept
+	service.Annotations[opaquePortsAnnotation] = "8080"
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Name: "6379", Port: 6379})
+	service = addOpaquePorts(service)
+	assert.Equal(t, "8080", service.Annotations[opaquePortsAnnotation])
+}
+
+func TestHandler_AddOpaquePortsToAppNamespace(t *testing.T) {
+	appLabels := map[string]string{appNameLabel: "db", appNamespaceLabel: "acorn"}
+	appNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo1", Labels: appLabels}}
+	req := newClientRequest(appNamespace,
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo1", Name: "mysql", Labels: appLabels},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "3306", Port: 3306, TargetPort: intstr.FromInt(3307)}},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo1", Name: "redis", Labels: appLabels},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "6379", Port: 6379}, {Name: "80", Port: 80, TargetPort: intstr.FromInt(8080)}},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo1", Name: "other"},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "5432", Port: 5432}},
+			},
+		},
+	)
+	if err := AddOpaquePortsToAppNamespace(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	var result corev1.Namespace
+	if err := req.Client.Get(req.Ctx, client.ObjectKeyFromObject(appNamespace), &result); err != nil {
+		t.Fatal(err)
+	}
+	// the default opaque ports of linkerd are kept
+	assert.Equal(t, "25,587,3306,3307,4444,5432,6379,9300,11211", result.Annotations[opaquePortsAnnotation])
+
+	// the opaque ports configured for the linkerd control plane replace the defaults
+	req = newClientRequest(appNamespace,
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "foo1", Name: "mysql", Labels: appLabels},
+			Spec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Name: "3306", Port: 3306, TargetPort: intstr.FromInt(3307)}},
+			},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: linkerdNamespace, Name: linkerdConfigName},
+			Data:       map[string]string{"values": "proxy:\n  opaquePorts: 25, 4444-4445,9300\n"},
+		},
+	)
+	if err := AddOpaquePortsToAppNamespace(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Client.Get(req.Ctx, client.ObjectKeyFromObject(appNamespace), &result); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "25,3307,9300,4444-4445", result.Annotations[opaquePortsAnnotation])
+}
+
+func TestHandler_AddLinkerdServer_IsolationOff(t *testing.T) {
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/server-isolation-off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+	resp := &router.ResponseWrapper{}
+	if err := AddLinkerdServer(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, resp.Objs)
+}
+
+func TestHandler_AddAuthorizationPolicy(t *testing.T) {
+	h := Handler{
+		clusterDomain:       "cluster.local",
+		ingressEndpointList: []IngressEndpoint{{Namespace: "kube-system", Name: "traefik"}},
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy", h.AddAuthorizationPolicy)
+}
+
+func TestHandler_AddAuthorizationPolicy_Ingress(t *testing.T) {
+	h := Handler{
+		clusterDomain: "cluster.local",
+		ingressEndpointList: []IngressEndpoint{
+			{Namespace: "kube-system", Name: "traefik"},
+			{Namespace: "ingress-nginx", Name: "ingress-nginx-controller", AuthMode: IngressAuthModeIdentity},
+		},
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-with-ingress", h.AddAuthorizationPolicy)
+}
+
+func TestHandler_AddAuthorizationPolicy_IngressDiscovery(t *testing.T) {
+	h := Handler{
+		clusterDomain:    "cluster.local",
+		ingressDiscovery: true,
+		ingressAuthMode:  IngressAuthModeAuto,
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-ingress-discovery", h.AddAuthorizationPolicy)
+}
+
+func TestHandler_AddAuthorizationPolicy_PerAppIdentities(t *testing.T) {
+	h := Handler{
+		clusterDomain:    "cluster.local",
+		perAppIdentities: true,
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-per-app-identities", h.AddAuthorizationPolicy)
+}
+
+func TestHandler_AddAuthorizationPolicy_IdentityRefs(t *testing.T) {
+	h := Handler{
+		clusterDomain: "cluster.local",
+		identityRefs:  true,
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-identity-refs", h.AddAuthorizationPolicy)
+}
+
+func TestMeshTLSAuthenticationSpec_IdentityRefs(t *testing.T) {
+	h := Handler{identityRefs: true}
+	pods := []corev1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "foo2", Name: "db"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "foo1", Name: "web-1"}, Spec: corev1.PodSpec{ServiceAccountName: "web"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "foo1", Name: "web-2"}, Spec: corev1.PodSpec{ServiceAccountName: "web"}},
+	}
+
+	foo1 := gatewayapiv1alpha2.Namespace("foo1")
+	foo2 := gatewayapiv1alpha2.Namespace("foo2")
+	assert.Equal(t, policyv1alpha1.MeshTLSAuthenticationSpec{
+		IdentityRefs: []gatewayapiv1alpha2.PolicyTargetReference{
+			{Kind: "ServiceAccount", Name: "default", Namespace: &foo2},
+			{Kind: "ServiceAccount", Name: "web", Namespace: &foo1},
+		},
+	}, h.meshTLSAuthenticationSpec(podServiceAccounts(pods), "cluster.local"))
+}
+
+func TestResolveIdentityRefs(t *testing.T) {
+	ctx := context.Background()
+	crd := func(properties ...string) *apiextensionsv1.CustomResourceDefinition {
+		spec := apiextensionsv1.JSONSchemaProps{Properties: map[string]apiextensionsv1.JSONSchemaProps{}}
+		for _, property := range properties {
+			spec.Properties[property] = apiextensionsv1.JSONSchemaProps{Type: "array"}
+		}
+		return &apiextensionsv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: meshTLSAuthenticationCRDName},
+			Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+				Versions: []apiextensionsv1.CustomResourceDefinitionVersion{
+					{
+						Name:   "v1alpha1",
+						Served: true,
+						Schema: &apiextensionsv1.CustomResourceValidation{
+							OpenAPIV3Schema: &apiextensionsv1.JSONSchemaProps{
+								Properties: map[string]apiextensionsv1.JSONSchemaProps{"spec": spec},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	mode, err := ResolveIdentityRefs(ctx, apiextensionsfake.NewSimpleClientset(crd("identities", "identityRefs")), IdentityRefsAuto)
+	assert.NoError(t, err)
+	assert.Equal(t, IdentityRefsEnabled, mode)
+
+	mode, err = ResolveIdentityRefs(ctx, apiextensionsfake.NewSimpleClientset(crd("identities")), IdentityRefsAuto)
+	assert.NoError(t, err)
+	assert.Equal(t, IdentityRefsDisabled, mode)
+
+	// without the CRD the identity strings are used
+	mode, err = ResolveIdentityRefs(ctx, apiextensionsfake.NewSimpleClientset(), IdentityRefsAuto)
+	assert.NoError(t, err)
+	assert.Equal(t, IdentityRefsDisabled, mode)
+
+	mode, err = ResolveIdentityRefs(ctx, apiextensionsfake.NewSimpleClientset(), IdentityRefsEnabled)
+	assert.NoError(t, err)
+	assert.Equal(t, IdentityRefsEnabled, mode)
+
+	_, err = ResolveIdentityRefs(ctx, apiextensionsfake.NewSimpleClientset(), "invalid")
+	assert.Error(t, err)
+}
+
+func TestHandler_TrustDomain(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: linkerdNamespace, Name: linkerdConfigName},
+		Data: map[string]string{
+			"values": "clusterDomain: cluster.local\nidentityTrustDomain: example.org\n",
+		},
+	}
+
+	h := Handler{clusterDomain: "cluster.local"}
+	trustDomain, err := h.trustDomain(tester.NewRequest(t, scheme.Scheme, &corev1.Namespace{}, configMap))
+	assert.NoError(t, err)
+	assert.Equal(t, "example.org", trustDomain)
+
+	// without linkerd-config the cluster domain is used
+	trustDomain, err = h.trustDomain(tester.NewRequest(t, scheme.Scheme, &corev1.Namespace{}))
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster.local", trustDomain)
+
+	h.clusterDomainOverride = true
+	trustDomain, err = h.trustDomain(tester.NewRequest(t, scheme.Scheme, &corev1.Namespace{}, configMap))
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster.local", trustDomain)
+}
+
+func TestHandler_AddAuthorizationPolicy_TrustDomain(t *testing.T) {
+	h := Handler{
+		clusterDomain: "cluster.local",
+	}
+	// the handler is shared by the workers of the router, the trust domain of a request must not leak into others
+	for _, testdata := range []string{"testdata/authorization-policy-trust-domain", "testdata/authorization-policy"} {
+		testdata := testdata
+		t.Run(testdata, func(t *testing.T) {
+			t.Parallel()
+			tester.DefaultTest(t, scheme.Scheme, testdata, h.AddAuthorizationPolicy)
+		})
+	}
+}
+
+func TestHandler_AddAuthorizationPolicy_Permissive(t *testing.T) {
+	h := Handler{
+		clusterDomain: "cluster.local",
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-permissive", h.AddAuthorizationPolicy)
+}
+
+func TestHandler_AddAuthorizationPolicy_IsolationOff(t *testing.T) {
+	h := Handler{
+		clusterDomain: "cluster.local",
+	}
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/authorization-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.SetAnnotations(map[string]string{isolationAnnotation: isolationOff})
+	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+	resp := &router.ResponseWrapper{}
+	if err := h.AddAuthorizationPolicy(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, resp.Objs)
+}
+
+func TestHandler_AddAuthorizationPolicy_InjectDisabled(t *testing.T) {
+	h := Handler{
+		clusterDomain: "cluster.local",
+	}
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/authorization-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	input.SetAnnotations(map[string]string{serviceMeshAnnotation: "disabled"})
+	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+	resp := &router.ResponseWrapper{}
+	if err := h.AddAuthorizationPolicy(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, resp.Objs)
+}
+
+func TestHandler_NoAppNamespace(t *testing.T) {
+	h := Handler{
+		clusterDomain: "cluster.local",
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/no-app-namespace", h.AddAuthorizationPolicy)
+}
+
+func TestHandler_ConfigureNetworkAuthorizationForIngress(t *testing.T) {
+	h := Handler{
+		ingressEndpointList: []IngressEndpoint{{Namespace: "kube-system", Name: "traefik"}},
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/network-authentication", h.ConfigureNetworkAuthorizationForIngress)
+}
+
+func TestHandler_ConfigureNetworkAuthorizationForIngress_Selector(t *testing.T) {
+	h := Handler{
+		ingressEndpointSelector: labels.SelectorFromSet(map[string]string{"app.kubernetes.io/component": "controller"}),
+		ingressAuthMode:         IngressAuthModeAuto,
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/network-authentication-selector", h.ConfigureNetworkAuthorizationForIngress)
+}
+
+func TestHandler_ConfigureNetworkAuthorizationForIngress_Discovery(t *testing.T) {
+	h := Handler{
+		ingressDiscovery: true,
+		ingressAuthMode:  IngressAuthModeNetwork,
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/network-authentication-discovery", h.ConfigureNetworkAuthorizationForIngress)
+}
+
+func TestHandler_ConfigureNetworkAuthorizationForIngress_DualStack(t *testing.T) {
+	h := Handler{
+		ingressEndpointList: []IngressEndpoint{{Namespace: "kube-system", Name: "traefik"}},
+		aggregateNetworks:   true,
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/network-authentication-dual-stack", h.ConfigureNetworkAuthorizationForIngress)
+}
+
+func TestNetworksForAddresses(t *testing.T) {
+	cidrs := func(networks []*policyv1alpha1.Network) (result []string) {
+		for _, network := range networks {
+			result = append(result, network.Cidr)
+		}
+		return result
+	}
+
+	addresses := []string{"10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.0", "10.0.0.5", "::ffff:10.0.0.5", "fd00::1", "invalid"}
+	assert.Equal(t, []string{"10.0.0.0/32", "10.0.0.1/32", "10.0.0.2/32", "10.0.0.3/32", "10.0.0.5/32", "fd00::1/128"}, cidrs(networksForAddresses(addresses, false)))
+	assert.Equal(t, []string{"10.0.0.0/30", "10.0.0.5/32", "fd00::1/128"}, cidrs(networksForAddresses(addresses, true)))
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32"}, cidrs(networksForAddresses([]string{"10.0.0.1", "10.0.0.2"}, true)))
+	assert.Empty(t, networksForAddresses(nil, true))
+}
+
+func TestHandler_ConfigureNetworkAuthorizationForIngress_NotIngress(t *testing.T) {
+	h := Handler{
+		ingressEndpointList: []IngressEndpoint{{Namespace: "kube-system", Name: "nginx"}},
+	}
+	harness, input, err := tester.FromDir(scheme.Scheme, "testdata/network-authentication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := tester.NewRequest(t, harness.Scheme, input, harness.Existing...)
+	resp := &router.ResponseWrapper{}
+	if err := h.ConfigureNetworkAuthorizationForIngress(req, resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, resp.Objs)
+}
+
+func TestHandler_ConfigureMeshAuthorizationForIngress(t *testing.T) {
+	h := Handler{
+		clusterDomain:       "cluster.local",
+		ingressEndpointList: []IngressEndpoint{{Namespace: "kube-system", Name: "traefik", AuthMode: IngressAuthModeIdentity}},
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/ingress-mesh-authentication", h.ConfigureNetworkAuthorizationForIngress)
+}
+
+func TestResolveIngressAuthModes(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "traefik"},
+	}
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-system",
+			Name:      "traefik-5fbx7",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "traefik"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{{
+			Addresses: []string{"10.42.0.107"},
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "kube-system", Name: "traefik"},
+		}},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "traefik"},
+	}
+	ingressEndpoints := []IngressEndpoint{{Namespace: "kube-system", Name: "traefik"}}
+
+	resolved, err := ResolveIngressAuthModes(context.Background(), fake.NewSimpleClientset(service, slice, pod), IngressAuthModeAuto, ingressEndpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, IngressAuthModeNetwork, resolved[0].AuthMode)
+
+	pod.Annotations = map[string]string{proxyVersionAnnotation: "stable-2.12.3"}
+	resolved, err = ResolveIngressAuthModes(context.Background(), fake.NewSimpleClientset(service, slice, pod), IngressAuthModeAuto, ingressEndpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, IngressAuthModeIdentity, resolved[0].AuthMode)
+
+	resolved, err = ResolveIngressAuthModes(context.Background(), fake.NewSimpleClientset(), IngressAuthModeAuto, ingressEndpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, IngressAuthModeNetwork, resolved[0].AuthMode)
+
+	resolved, err = ResolveIngressAuthModes(context.Background(), fake.NewSimpleClientset(), IngressAuthModeIdentity, ingressEndpoints)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, IngressAuthModeIdentity, resolved[0].AuthMode)
+
+	_, err = ResolveIngressAuthModes(context.Background(), fake.NewSimpleClientset(), "foo", ingressEndpoints)
+	assert.Error(t, err)
+}
+
+func TestParseIngressEndpoints(t *testing.T) {
+	endpoints, err := ParseIngressEndpoints("traefik/traefik, ingress-nginx/ingress-nginx-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []IngressEndpoint{
+		{Namespace: "traefik", Name: "traefik"},
+		{Namespace: "ingress-nginx", Name: "ingress-nginx-controller"},
+	}, endpoints)
+
+	_, err = ParseIngressEndpoints("traefik")
+	assert.Error(t, err)
+}
+
+func TestHandler_ConfigureNetworkPolicyForBuildServer(t *testing.T) {
+	h := Handler{
+		ingressEndpointList: []IngressEndpoint{{Namespace: "kube-system", Name: "traefik"}},
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/builder", h.ConfigureNetworkPolicyForBuildServer)
+}
+
+func TestHandler_AddAuthorizationPolicy_Router(t *testing.T) {
+	h := Handler{
+		clusterDomain:       "cluster.local",
+		ingressEndpointList: []IngressEndpoint{{Namespace: "kube-system", Name: "traefik"}},
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-with-router-service", h.AddAuthorizationPolicy)
+}
+
+func TestHandler_AddAuthorizationPolicy_MeshedRouter(t *testing.T) {
+	h := Handler{
+		clusterDomain: "cluster.local",
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-with-meshed-router", h.AddAuthorizationPolicy)
+}
+
+func TestHandler_AddAuthorizationPolicy_CrossProject(t *testing.T) {
+	h := Handler{
+		clusterDomain:       "cluster.local",
+		ingressEndpointList: []IngressEndpoint{{Namespace: "kube-system", Name: "traefik"}},
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-cross-project", h.AddAuthorizationPolicy)
+}
+
+func TestHandler_AddAuthorizationPolicy_NetworkPolicies(t *testing.T) {
+	h := Handler{
+		clusterDomain:       "cluster.local",
+		ingressEndpointList: []IngressEndpoint{{Namespace: "kube-system", Name: "traefik"}},
+		networkPolicies:     true,
+	}
+	tester.DefaultTest(t, scheme.Scheme, "testdata/authorization-policy-network-policies", h.AddAuthorizationPolicy)
+}
+
+type recordingTrigger struct {
+	keys []string
+}
+
+func (r *recordingTrigger) Trigger(gvk schema.GroupVersionKind, key string, delay time.Duration) error {
+	r.keys = append(r.keys, gvk.Kind+" "+key)
+	return nil
+}
+
+func TestHandler_TriggerProject(t *testing.T) {
+	k8s := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "acorn", Labels: map[string]string{"acorn.io/project": "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other", Labels: map[string]string{"acorn.io/project": "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo1", Labels: map[string]string{appNamespaceLabel: "acorn"}}},
+	)
+	ctx := context.Background()
+
+	trigger := &recordingTrigger{}
+	h := Handler{client: k8s, trigger: trigger}
+	server := &serverv1beta1.Server{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo1", Name: "foo-80", Labels: map[string]string{appNamespaceLabel: "acorn"}},
+	}
+	if err := h.TriggerProjectForServer(tester.NewRequest(t, scheme.Scheme, server), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"Namespace acorn"}, trigger.keys)
+
+	// removed objects have no labels, the project is found through the app namespace
+	trigger.keys = nil
+	if err := h.TriggerProjectForServer(router.Request{Ctx: ctx, Namespace: "foo1", Name: "foo-80"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"Namespace acorn"}, trigger.keys)
+
+	trigger.keys = nil
+	if err := h.TriggerProjectForServer(router.Request{Ctx: ctx, Namespace: acornSystemNamespace, Name: "foo-80"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []string{"Namespace acorn", "Namespace other"}, trigger.keys)
+
+	trigger.keys = nil
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: acornSystemNamespace, Name: "router-pod", Labels: map[string]string{appNamespaceLabel: "other"}},
+	}
+	if err := h.TriggerProjectForRouterPod(tester.NewRequest(t, scheme.Scheme, pod), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"Namespace other"}, trigger.keys)
+
+	trigger.keys = nil
+	appPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "foo1", Name: "web", Labels: map[string]string{appNameLabel: "web", appNamespaceLabel: "acorn"}},
+	}
+	if err := h.TriggerProjectForAppPod(tester.NewRequest(t, scheme.Scheme, appPod), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"Namespace acorn"}, trigger.keys)
+
+	trigger.keys = nil
+	if err := h.TriggerProjectForAppPod(router.Request{Ctx: ctx, Namespace: "foo1", Name: "web"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"Namespace acorn"}, trigger.keys)
+
+	trigger.keys = nil
+	if err := h.TriggerProjectForAppNamespace(router.Request{Ctx: ctx, Name: "foo2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.ElementsMatch(t, []string{"Namespace acorn", "Namespace other"}, trigger.keys)
+}
+
+func TestHandler_CleanupProject(t *testing.T) {
+	h := Handler{}
+
+	project := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "acorn",
+			Labels: map[string]string{"acorn.io/project": "true"},
+			Annotations: map[string]string{
+				serviceMeshAnnotation: "enabled",
+				injectedAnnotation:    "true",
+			},
+		},
+	}
+	// the plugin doesn't create objects for a project without apps
+	if err := h.CleanupProject(tester.NewRequest(t, scheme.Scheme, project), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, project.Finalizers)
+
+	app := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "app",
+			Labels: map[string]string{appNamespaceLabel: "acorn"},
+		},
+	}
+	if err := h.CleanupProject(tester.NewRequest(t, scheme.Scheme, project, app), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{projectFinalizer}, project.Finalizers)
+
+	// the objects are removed when isolation is off, so the finalizer is no longer needed
+	project.Annotations[isolationAnnotation] = isolationOff
+	if err := h.CleanupProject(tester.NewRequest(t, scheme.Scheme, project, app), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, project.Finalizers)
+	delete(project.Annotations, isolationAnnotation)
+	project.Finalizers = []string{projectFinalizer}
+
+	// the namespace is no longer a project, the annotations set by the plugin are removed along with the finalizer
+	delete(project.Labels, "acorn.io/project")
+	if err := h.CleanupProject(tester.NewRequest(t, scheme.Scheme, project), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, project.Finalizers)
+	assert.Empty(t, project.Annotations)
+
+	// an inject annotation that wasn't set by the plugin is kept
+	other := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "other",
+			Annotations: map[string]string{serviceMeshAnnotation: "enabled"},
+			Finalizers:  []string{projectFinalizer},
+		},
+	}
+	if err := h.CleanupProject(tester.NewRequest(t, scheme.Scheme, other), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, other.Finalizers)
+	assert.Equal(t, "enabled", other.Annotations[serviceMeshAnnotation])
+
+	deleted := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "deleted",
+			Labels:            map[string]string{"acorn.io/project": "true"},
+			DeletionTimestamp: &metav1.Time{Time: time.Now()},
+			Finalizers:        []string{"other", projectFinalizer},
+		},
+	}
+	if err := h.CleanupProject(tester.NewRequest(t, scheme.Scheme, deleted), nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"other"}, deleted.Finalizers)
+}
+
+func TestLabelManagedObjects(t *testing.T) {
+	handler := labelManagedObjects(router.HandlerFunc(func(req router.Request, resp router.Response) error {
+		resp.Objects(&policyv1alpha1.AuthorizationPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "policy",
+				Labels: map[string]string{"foo": "bar"},
+			},
+		})
+		return nil
+	}))
+
+	resp := &tester.Response{}
+	if err := handler.Handle(router.Request{}, resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, resp.Collected, 1)
+	assert.Equal(t, map[string]string{
+		"foo":          "bar",
+		managedByLabel: managedByValue,
+	}, resp.Collected[0].GetLabels())
+}
+
+func TestUninstall(t *testing.T) {
+	managed := map[string]string{managedByLabel: managedByValue}
+	newClient := func() client.Client {
+		return crfake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+			&serverv1beta1.Server{ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "web", Labels: managed}},
+			&serverv1beta1.Server{ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "other"}},
+			&policyv1alpha1.AuthorizationPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "authz", Labels: managed}},
+			&policyv1alpha1.MeshTLSAuthentication{ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "mesh", Labels: managed}},
+			&policyv1alpha1.NetworkAuthentication{ObjectMeta: metav1.ObjectMeta{Namespace: "traefik", Name: "ingress", Labels: managed}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name: "acorn",
+				Annotations: map[string]string{
+					serviceMeshAnnotation:          "enabled",
+					injectedAnnotation:             "true",
+					defaultInboundPolicyAnnotation: defaultInboundPolicyAudit,
+				},
+				Finalizers: []string{projectFinalizer},
+			}},
+			&corev1.Service{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "app",
+				Name:      "db",
+				Annotations: map[string]string{
+					opaquePortsAnnotation:    "3306",
+					opaquePortsSetAnnotation: "3306",
+				},
+			}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        "user",
+				Annotations: map[string]string{serviceMeshAnnotation: "enabled"},
+			}},
+			&appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   acornImageSystemNamespace,
+					Name:        "bld-acorn",
+					Annotations: map[string]string{injectedAnnotation: "true"},
+				},
+				Spec: appsv1.DeploymentSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{serviceMeshAnnotation: "enabled"},
+						},
+					},
+				},
+			},
+		).Build()
+	}
+
+	expected := `%[1]s AuthorizationPolicy app/authz
+%[1]s MeshTLSAuthentication app/mesh
+%[1]s NetworkAuthentication traefik/ingress
+%[1]s Server app/web
+%[2]s Namespace acorn: removed linkerd.io/inject annotation, removed config.linkerd.io/default-inbound-policy annotation, removed acorn.io/linkerd-plugin finalizer
+%[2]s Service app/db: removed config.linkerd.io/opaque-ports annotation
+%[2]s Deployment acorn-image-system/bld-acorn: removed linkerd.io/inject annotation
+`
+
+	ctx := context.Background()
+	c := newClient()
+	out := &bytes.Buffer{}
+	if err := Uninstall(ctx, c, true, out); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, fmt.Sprintf(expected, "Would delete", "Would update"), out.String())
+
+	var servers serverv1beta1.ServerList
+	if err := c.List(ctx, &servers); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, servers.Items, 2)
+
+	out.Reset()
+	if err := Uninstall(ctx, c, false, out); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, fmt.Sprintf(expected, "Deleted", "Updated"), out.String())
+
+	if err := c.List(ctx, &servers); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, servers.Items, 1)
+	assert.Equal(t, "other", servers.Items[0].Name)
+
+	var policies policyv1alpha1.AuthorizationPolicyList
+	if err := c.List(ctx, &policies); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, policies.Items)
+
+	var project corev1.Namespace
+	if err := c.Get(ctx, client.ObjectKey{Name: "acorn"}, &project); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, project.Annotations)
+	assert.Empty(t, project.Finalizers)
+
+	var user corev1.Namespace
+	if err := c.Get(ctx, client.ObjectKey{Name: "user"}, &user); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "enabled", user.Annotations[serviceMeshAnnotation])
+
+	var builder appsv1.Deployment
+	if err := c.Get(ctx, client.ObjectKey{Namespace: acornImageSystemNamespace, Name: "bld-acorn"}, &builder); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, builder.Annotations)
+	assert.Empty(t, builder.Spec.Template.Annotations)
+
+	// everything is removed, running it again is a no-op
+	out.Reset()
+	if err := Uninstall(ctx, c, false, out); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, out.String())
+}
+
+func TestReleaseIngressEndpoints(t *testing.T) {
+	ownedByEndpoints := map[string]string{apply.LabelGVK: corev1.SchemeGroupVersion.WithKind("Endpoints").String()}
+	ownedByService := map[string]string{apply.LabelGVK: corev1.SchemeGroupVersion.WithKind("Service").String()}
+	c := crfake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		&policyv1alpha1.NetworkAuthentication{ObjectMeta: metav1.ObjectMeta{Namespace: "traefik", Name: "acorn-ingress-network-authentication", Annotations: ownedByEndpoints}},
+		&policyv1alpha1.MeshTLSAuthentication{ObjectMeta: metav1.ObjectMeta{Namespace: "traefik", Name: "acorn-ingress-mesh-authentication", Annotations: ownedByEndpoints}},
+		&policyv1alpha1.NetworkAuthentication{ObjectMeta: metav1.ObjectMeta{Namespace: "traefik", Name: "acorn-ingress-traefik", Annotations: ownedByService}},
+		&policyv1alpha1.NetworkAuthentication{ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "other"}},
+	).Build()
+
+	ctx := context.Background()
+	out := &bytes.Buffer{}
+	if err := releaseIngressEndpoints(ctx, c, true, out); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `Would delete MeshTLSAuthentication traefik/acorn-ingress-mesh-authentication
+Would delete NetworkAuthentication traefik/acorn-ingress-network-authentication
+`, out.String())
+
+	out.Reset()
+	if err := releaseIngressEndpoints(ctx, c, false, out); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `Deleted MeshTLSAuthentication traefik/acorn-ingress-mesh-authentication
+Deleted NetworkAuthentication traefik/acorn-ingress-network-authentication
+`, out.String())
+
+	var networkAuthentications policyv1alpha1.NetworkAuthenticationList
+	if err := c.List(ctx, &networkAuthentications); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, networkAuthentication := range networkAuthentications.Items {
+		names = append(names, networkAuthentication.Name)
+	}
+	assert.ElementsMatch(t, []string{"acorn-ingress-traefik", "other"}, names)
+
+	// nothing is left to release, running it again is a no-op
+	out.Reset()
+	if err := releaseIngressEndpoints(ctx, c, false, out); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, out.String())
+}
+
+func TestMigrate(t *testing.T) {
+	legacy := func(name string) *policyv1alpha1.NetworkAuthentication {
+		return &policyv1alpha1.NetworkAuthentication{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "traefik",
+			Name:        name,
+			Annotations: map[string]string{apply.LabelGVK: corev1.SchemeGroupVersion.WithKind("Endpoints").String()},
+		}}
+	}
+	c := crfake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        acornSystemNamespace,
+			Annotations: map[string]string{migrationsAnnotation: "other"},
+		}},
+		legacy("acorn-ingress-traefik"),
+	).Build()
+
+	ctx := context.Background()
+	migrate(ctx, c)
+
+	var networkAuthentications policyv1alpha1.NetworkAuthenticationList
+	if err := c.List(ctx, &networkAuthentications); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, networkAuthentications.Items)
+
+	var namespace corev1.Namespace
+	if err := c.Get(ctx, client.ObjectKey{Name: acornSystemNamespace}, &namespace); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "other,"+ingressServiceOwnerMigration, namespace.Annotations[migrationsAnnotation])
+
+	// the migration ran already, so it doesn't list the authentications again
+	if err := c.Create(ctx, legacy("acorn-ingress-nginx")); err != nil {
+		t.Fatal(err)
+	}
+	migrate(ctx, c)
+	if err := c.List(ctx, &networkAuthentications); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, networkAuthentications.Items, 1)
+
+	// without acorn there is nothing to migrate
+	migrate(ctx, crfake.NewClientBuilder().WithScheme(scheme.Scheme).Build())
 }
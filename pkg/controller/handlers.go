@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/acorn-io/baaah/pkg/backend"
 	"github.com/acorn-io/baaah/pkg/name"
 	"github.com/acorn-io/baaah/pkg/router"
 	"github.com/sirupsen/logrus"
@@ -14,6 +16,7 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	gatewayapiv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
 
@@ -26,6 +29,7 @@ const (
 	proxySidecarContainerName = "linkerd-proxy"
 
 	ingressNetworkAuthenticationName = "acorn-ingress-network-authentication"
+	ingressMeshTLSAuthenticationName = "acorn-ingress-mesh-authentication"
 	routerNetworkAuthenticationName  = "acorn-router-network-authentication"
 	serviceNameLabel                 = "acorn.io/service-name"
 
@@ -33,34 +37,93 @@ const (
 )
 
 type Handler struct {
-	client                   kubernetes.Interface
-	debugImage               string
-	clusterDomain            string
-	ingressEndpointName      string
-	ingressEndpointNamespace string
+	client                    kubernetes.Interface
+	debugImage                string
+	debugImagePullPolicy      corev1.PullPolicy
+	debugImagePullSecret      string
+	shutdownSecurityContext   *corev1.SecurityContext
+	sidecarShutdown           string
+	sidecarShutdownTimeout    time.Duration
+	sidecarShutdownEscalation string
+	clusterDomain             string
+	clusterDomainOverride     bool
+	ingressEndpointList       []IngressEndpoint
+	ingressEndpointSelector   labels.Selector
+	ingressDiscovery          bool
+	ingressAuthMode           string
+	aggregateNetworks         bool
+	perAppIdentities          bool
+	identityRefs              bool
+	networkPolicies           bool
+	trigger                   backend.Trigger
+	recorder                  record.EventRecorder
 }
 
-// AddAnnotations adds linkerd annotations to all acorn projects so that it can propagate into app namespaces
-func AddAnnotations(req router.Request, resp router.Response) error {
+// AddAnnotations adds linkerd annotations to all acorn projects so that it can propagate into app namespaces. An
+// inject annotation that is already set on the project is left as is. An enabled one is considered added by the plugin,
+// unless the injected annotation says otherwise.
+func (h Handler) AddAnnotations(req router.Request, resp router.Response) error {
 	projectNamespace := req.Object.(*corev1.Namespace)
 
 	if projectNamespace.Annotations == nil {
 		projectNamespace.Annotations = map[string]string{}
 	}
 
-	if projectNamespace.Annotations[serviceMeshAnnotation] == "enabled" {
-		return nil
+	changed := false
+	if projectNamespace.Annotations[linkerdAnnotation] == "disabled" {
+		if projectNamespace.Annotations[serviceMeshAnnotation] == "enabled" {
+			logrus.Infof("Updating project %v to remove linkerd service mesh annotation", projectNamespace.Name)
+			delete(projectNamespace.Annotations, serviceMeshAnnotation)
+			delete(projectNamespace.Annotations, injectedAnnotation)
+			changed = true
+		}
+	} else if projectNamespace.Annotations[serviceMeshAnnotation] == "" {
+		logrus.Infof("Updating project %v to inject linkerd service mesh annotation", projectNamespace.Name)
+		projectNamespace.Annotations[serviceMeshAnnotation] = "enabled"
+		projectNamespace.Annotations[injectedAnnotation] = "true"
+		changed = true
+	} else if _, ok := projectNamespace.Annotations[injectedAnnotation]; !ok && projectNamespace.Annotations[serviceMeshAnnotation] == "enabled" {
+		// Previous versions of the plugin didn't record that they added the inject annotation
+		logrus.Infof("Updating project %v to record the linkerd service mesh annotation as added by the plugin", projectNamespace.Name)
+		projectNamespace.Annotations[injectedAnnotation] = "true"
+		changed = true
+	}
+
+	// Previous versions of the plugin set the audit default inbound policy for audit isolation
+	if projectNamespace.Annotations[defaultInboundPolicyAnnotation] == defaultInboundPolicyAudit {
+		logrus.Infof("Updating project %v to stop auditing inbound traffic", projectNamespace.Name)
+		delete(projectNamespace.Annotations, defaultInboundPolicyAnnotation)
+		changed = true
+	}
+
+	// With native sidecars kubernetes shuts down the proxy of a job once its other containers completed
+	if h.sidecarShutdown == SidecarShutdownNativeSidecar && projectNamespace.Annotations[linkerdAnnotation] != "disabled" {
+		if projectNamespace.Annotations[nativeSidecarAnnotation] == "" {
+			logrus.Infof("Updating project %v to inject linkerd as native sidecar", projectNamespace.Name)
+			projectNamespace.Annotations[nativeSidecarAnnotation] = "true"
+			projectNamespace.Annotations[nativeSidecarSetAnnotation] = "true"
+			changed = true
+		}
+	} else if projectNamespace.Annotations[nativeSidecarSetAnnotation] == "true" {
+		logrus.Infof("Updating project %v to stop injecting linkerd as native sidecar", projectNamespace.Name)
+		delete(projectNamespace.Annotations, nativeSidecarAnnotation)
+		delete(projectNamespace.Annotations, nativeSidecarSetAnnotation)
+		changed = true
 	}
 
-	logrus.Infof("Updating project %v to inject linkerd service mesh annotation", projectNamespace.Name)
-	projectNamespace.Annotations[serviceMeshAnnotation] = "enabled"
+	if !changed {
+		return nil
+	}
 	if err := req.Client.Update(req.Ctx, projectNamespace); err != nil {
 		return err
 	}
 	return nil
 }
 
-// KillLinkerdSidecar finds all the pods that belongs to acorn jobs but stuck at completing because of linkerd sidecar. It launches ephemeral container to kill sidecar
+// KillLinkerdSidecar finds all the pods that belongs to acorn jobs but stuck at completing because of linkerd sidecar. It
+// tries the shutdown methods of the sidecar shutdown strategy in order. Native sidecars are shut down by kubernetes and
+// are left alone. The attempts are recorded on the pod and repeated with backoff until the sidecar shutdown timeout,
+// after which the pod is escalated.
 func (h Handler) KillLinkerdSidecar(req router.Request, resp router.Response) error {
 	pod := req.Object.(*corev1.Pod)
 
@@ -69,46 +132,73 @@ func (h Handler) KillLinkerdSidecar(req router.Request, resp router.Response) er
 		return nil
 	}
 
+	proxy, terminated := sidecarState(pod)
+	if proxy == nil || terminated {
+		return nil
+	}
+
 	// wait for all the containers to terminate
-	foundSidecar := false
 	for _, containerStatus := range pod.Status.ContainerStatuses {
-		if containerStatus.Name != proxySidecarContainerName && containerStatus.State.Terminated == nil {
+		if containerStatus.Name != proxy.Name && containerStatus.State.Terminated == nil {
 			return nil
 		}
-
-		if containerStatus.Name == proxySidecarContainerName {
-			foundSidecar = true
-		}
 	}
 
-	if !foundSidecar {
+	progress := sidecarShutdownProgressOf(pod)
+	if progress.Escalated {
 		return nil
 	}
 
-	// If pod is already configured with ephemeral container, skip
-	if len(pod.Spec.EphemeralContainers) > 0 {
-		return nil
+	now := time.Now()
+	if progress.Attempts > 0 {
+		if now.Sub(progress.Started.Time) >= h.sidecarShutdownTimeout {
+			return h.escalateSidecarShutdown(req.Ctx, pod, progress)
+		}
+
+		if next := progress.Last.Add(sidecarShutdownBackoff(progress.Attempts)); now.Before(next) {
+			resp.RetryAfter(next.Sub(now))
+			return nil
+		}
+
+		failure := shutdownContainerFailure(pod)
+		if failure == "" {
+			failure = "the linkerd proxy is still running"
+		}
+		h.recorder.Eventf(pod, corev1.EventTypeWarning, sidecarShutdownFailedReason, "Attempt %d to shut down the linkerd proxy failed: %s", progress.Attempts, failure)
 	}
 
-	logrus.Infof("Launching ephemeral container to kill pod %v/%v sidecar", pod.Namespace, pod.Name)
-	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
-		TargetContainerName: proxySidecarContainerName,
-		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
-			Name:            "shutdown-sidecar",
-			Image:           h.debugImage,
-			ImagePullPolicy: corev1.PullAlways,
-			Command: []string{
-				"curl",
-				"-X",
-				"POST",
-				"http://localhost:4191/shutdown",
-			},
-		},
-	})
-	if _, err := h.client.CoreV1().Pods(pod.Namespace).UpdateEphemeralContainers(req.Ctx, pod.Name, pod, metav1.UpdateOptions{}); err != nil {
+	methods := h.sidecarShutdownMethods()
+	for i, method := range methods {
+		logrus.Infof("Shutting down pod %v/%v sidecar through %v", pod.Namespace, pod.Name, method)
+		err := method.Shutdown(req.Ctx, pod)
+		if err == nil {
+			h.recorder.Eventf(pod, corev1.EventTypeNormal, sidecarShutdownReason, "Shutting down the linkerd proxy through %v", method)
+			break
+		}
+
+		if i == len(methods)-1 {
+			logrus.Warnf("Failed to shut down pod %v/%v sidecar through %v: %v", pod.Namespace, pod.Name, method, err)
+		} else {
+			logrus.Warnf("Failed to shut down pod %v/%v sidecar through %v, falling back to %v: %v", pod.Namespace, pod.Name, method, methods[i+1], err)
+		}
+		h.recorder.Eventf(pod, corev1.EventTypeWarning, sidecarShutdownFailedReason, "Failed to shut down the linkerd proxy through %v: %v", method, err)
+	}
+
+	progress.Attempts++
+	progress.Last = metav1.NewTime(now)
+	if progress.Started.IsZero() {
+		progress.Started = progress.Last
+	}
+	if err := h.recordSidecarShutdownProgress(req.Ctx, pod, progress); err != nil {
 		return err
 	}
 
+	// check on the proxy again, the pod isn't necessarily updated if the shutdown had no effect
+	delay := sidecarShutdownBackoff(progress.Attempts)
+	if remaining := h.sidecarShutdownTimeout - now.Sub(progress.Started.Time); remaining < delay {
+		delay = remaining
+	}
+	resp.RetryAfter(delay)
 	return nil
 }
 
@@ -121,6 +211,14 @@ func AddLinkerdServer(req router.Request, resp router.Response) error {
 		return nil
 	}
 
+	mode, err := projectIsolationMode(req, service.Labels[appNamespaceLabel])
+	if err != nil {
+		return err
+	}
+	if mode == isolationOff {
+		return nil
+	}
+
 	for _, port := range service.Spec.Ports {
 		resp.Objects(&serverv1beta1.Server{
 			ObjectMeta: metav1.ObjectMeta{
@@ -134,8 +232,9 @@ func AddLinkerdServer(req router.Request, resp router.Response) error {
 				},
 			},
 			Spec: serverv1beta1.ServerSpec{
-				PodSelector: metav1.SetAsLabelSelector(service.Spec.Selector),
-				Port:        intstr.FromInt(int(port.Port)),
+				PodSelector:   metav1.SetAsLabelSelector(service.Spec.Selector),
+				Port:          intstr.FromInt(int(port.Port)),
+				ProxyProtocol: proxyProtocol(service, port),
 			},
 		})
 	}
@@ -146,46 +245,56 @@ func AddLinkerdServer(req router.Request, resp router.Response) error {
 AddAuthorizationPolicy makes sure within each acorn project, apps can talk to each other. It does the following:
 1. Programs MeshTLSAuthentication for each app namespaces to represent all the service account identities in the same project
 2. For each server, create an AuthorizationPolicy per project to allow network access.
+The isolation mode of the project changes this, permissive isolation allows every meshed identity and no policies are
+created when isolation is off.
 */
 func (h Handler) AddAuthorizationPolicy(req router.Request, resp router.Response) error {
 	projectNamespace := req.Object.(*corev1.Namespace)
 
-	var appNamespaces corev1.NamespaceList
-	if err := req.Client.List(req.Ctx, &appNamespaces, &client.ListOptions{
-		LabelSelector: labels.SelectorFromSet(map[string]string{
-			"acorn.io/app-namespace": projectNamespace.Name,
-		}),
-	}); err != nil {
+	// Returning without objects removes the policies that were created for the project before
+	mode := isolationMode(projectNamespace)
+	if mode == isolationOff {
+		return nil
+	}
+
+	trustDomain, err := h.trustDomain(req)
+	if err != nil {
 		return err
 	}
 
-	// First, we create a MeshTLSAuthentication representing all the service accounts in the current project
-	var serviceaccountsIdentities []string
-	sort.SliceStable(appNamespaces.Items, func(i, j int) bool {
-		return appNamespaces.Items[i].Name < appNamespaces.Items[j].Name
-	})
-	for _, appNamespace := range appNamespaces.Items {
-		serviceaccountsIdentities = append(serviceaccountsIdentities, fmt.Sprintf("*.%s.serviceaccount.identity.linkerd.%v", appNamespace.Name, h.clusterDomain))
+	appNamespaces, err := listAppNamespaces(req, projectNamespace.Name)
+	if err != nil {
+		return err
 	}
 
-	if len(serviceaccountsIdentities) == 0 {
+	// First, we create a MeshTLSAuthentication representing all the service accounts in the current project
+	serviceAccounts, err := h.identities(req, appNamespaces)
+	if err != nil {
+		return err
+	}
+	if len(serviceAccounts) == 0 {
 		return nil
 	}
+	authenticationSpec := h.meshTLSAuthenticationSpec(serviceAccounts, trustDomain)
+	if mode == isolationPermissive {
+		// any identity can't be referenced, but it doesn't depend on the cluster domain either
+		authenticationSpec = policyv1alpha1.MeshTLSAuthenticationSpec{
+			Identities: []string{"*"},
+		}
+	}
 
 	resp.Objects(&policyv1alpha1.MeshTLSAuthentication{
 		ObjectMeta: metav1.ObjectMeta{
 			Namespace: projectNamespace.Name,
 			Name:      name.SafeConcatName("mesh-authn-profile", projectNamespace.Name),
 		},
-		Spec: policyv1alpha1.MeshTLSAuthenticationSpec{
-			Identities: serviceaccountsIdentities,
-		},
+		Spec: authenticationSpec,
 	})
 
 	// Second, For each Server(k8s service), we create an AuthorizationPolicy to allow network access to
 	// from all service account identities from the same project
 	var servers serverv1beta1.ServerList
-	for _, ns := range appNamespaces.Items {
+	for _, ns := range appNamespaces {
 		var result serverv1beta1.ServerList
 		if err := req.Client.List(req.Ctx, &result, &client.ListOptions{
 			Namespace: ns.Name,
@@ -195,49 +304,41 @@ func (h Handler) AddAuthorizationPolicy(req router.Request, resp router.Response
 		servers.Items = append(servers.Items, result.Items...)
 	}
 
-	// list all server in acorn-system that is exposed through router, configure network access for routers
-	// TODO: since router is based on klipper-lb and iptable forwarding, it bypasses linkerd-proxy. For now we hard-coded pod ip in allow list
-	var result serverv1beta1.ServerList
-	if err := req.Client.List(req.Ctx, &result, &client.ListOptions{
-		Namespace: acornSystemNamespace,
-		LabelSelector: labels.SelectorFromSet(map[string]string{
-			"acorn.io/app-namespace": projectNamespace.Name,
-		}),
-	}); err != nil {
+	// Servers in acorn-system are exposed through the router of the project, which must be allowed to reach the router
+	// Servers and the app Servers behind them
+	routerServers, err := listRouterServers(req, projectNamespace.Name)
+	if err != nil {
 		return err
 	}
-	servers.Items = append(servers.Items, result.Items...)
-	var networks []*policyv1alpha1.Network
-	for _, server := range result.Items {
-		var pods corev1.PodList
-		if err := req.Client.List(req.Ctx, &pods, &client.ListOptions{
-			Namespace:     acornSystemNamespace,
-			LabelSelector: labels.SelectorFromSet(server.Spec.PodSelector.MatchLabels),
-		}); err != nil {
-			return err
-		}
-		for _, pod := range pods.Items {
-			networks = append(networks, &policyv1alpha1.Network{
-				Cidr: pod.Status.PodIP,
-			})
-		}
+	servers.Items = append(servers.Items, routerServers...)
+
+	routerPods, err := listRouterPods(req, routerServers)
+	if err != nil {
+		return err
+	}
+	routerAuthentication, routerAuthenticationRef := h.routerAuthentication(projectNamespace.Name, routerPods, trustDomain)
+	if routerAuthentication != nil {
+		resp.Objects(routerAuthentication)
 	}
 
-	if len(networks) > 0 {
-		resp.Objects(&policyv1alpha1.NetworkAuthentication{
-			ObjectMeta: metav1.ObjectMeta{
-				Namespace: projectNamespace.Name,
-				Name:      name.SafeConcatName(routerNetworkAuthenticationName, projectNamespace.Name),
-			},
-			Spec: policyv1alpha1.NetworkAuthenticationSpec{
-				Networks: networks,
-			},
-		})
+	// Only servers whose service port is the backend of an Ingress should be reachable from the ingress controller
+	ingressBackendNamespaces := []string{acornSystemNamespace}
+	for _, ns := range appNamespaces {
+		ingressBackendNamespaces = append(ingressBackendNamespaces, ns.Name)
+	}
+	backends, err := listIngressBackends(req, ingressBackendNamespaces)
+	if err != nil {
+		return err
 	}
 
-	project := gatewayapiv1alpha2.Namespace(projectNamespace.Name)
-	ingressNamespace := gatewayapiv1alpha2.Namespace(h.ingressEndpointNamespace)
+	ingressEndpoints, err := h.ingressEndpoints(req)
+	if err != nil {
+		return err
+	}
 
+	project := gatewayapiv1alpha2.Namespace(projectNamespace.Name)
+	// grants tracks the projects for which a MeshTLSAuthentication has already been created
+	grants := map[string]bool{}
 	for _, server := range servers.Items {
 		resp.Objects(&policyv1alpha1.AuthorizationPolicy{
 			ObjectMeta: metav1.ObjectMeta{
@@ -261,55 +362,55 @@ func (h Handler) AddAuthorizationPolicy(req router.Request, resp router.Response
 			},
 		})
 
-		// Check if service is referenced by an ingress, and if so, create an authorization policy that
-		// allow traffic from ingress pod
-		// Todo: For now we want to allow access from ingress by default. We can program some smart way to figure out whether service needs to be exposed by ingress
+		// Allow access from the projects that are granted access to this server, either through the project or
+		// through the service the server belongs to
+		// In permissive isolation every meshed identity is already allowed
+		var allowedProjects []string
+		if mode != isolationPermissive {
+			allowedProjects, err = allowedProjectsForServer(req, projectNamespace, server)
+			if err != nil {
+				return err
+			}
+		}
+		for _, allowedProject := range allowedProjects {
+			if _, ok := grants[allowedProject]; !ok {
+				grant, err := h.grantMeshTLSAuthentication(req, projectNamespace.Name, allowedProject, trustDomain)
+				if err != nil {
+					return err
+				}
+				if grant != nil {
+					resp.Objects(grant)
+				}
+				grants[allowedProject] = grant != nil
+			}
+			if !grants[allowedProject] {
+				continue
+			}
 
-		resp.Objects(&policyv1alpha1.AuthorizationPolicy{
-			ObjectMeta: metav1.ObjectMeta{
-				Namespace: server.Namespace,
-				Name:      name.SafeConcatName("authz-profile-ingress", server.Name),
-			},
-			Spec: policyv1alpha1.AuthorizationPolicySpec{
-				TargetRef: gatewayapiv1alpha2.PolicyTargetReference{
-					Group: gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
-					Kind:  "Server",
-					Name:  gatewayapiv1alpha2.ObjectName(server.Name),
+			resp.Objects(&policyv1alpha1.AuthorizationPolicy{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: server.Namespace,
+					Name:      name.SafeConcatName("authz-profile", allowedProject, server.Name),
 				},
-				RequiredAuthenticationRefs: []gatewayapiv1alpha2.PolicyTargetReference{
-					{
-						Group:     gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
-						Kind:      "NetworkAuthentication",
-						Name:      ingressNetworkAuthenticationName,
-						Namespace: &ingressNamespace,
+				Spec: policyv1alpha1.AuthorizationPolicySpec{
+					TargetRef: gatewayapiv1alpha2.PolicyTargetReference{
+						Group: gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
+						Kind:  "Server",
+						Name:  gatewayapiv1alpha2.ObjectName(server.Name),
 					},
-				},
-			},
-		})
-
-		resp.Objects(&policyv1alpha1.AuthorizationPolicy{
-			ObjectMeta: metav1.ObjectMeta{
-				Namespace: server.Namespace,
-				Name:      name.SafeConcatName("authz-profile-ingress", server.Name),
-			},
-			Spec: policyv1alpha1.AuthorizationPolicySpec{
-				TargetRef: gatewayapiv1alpha2.PolicyTargetReference{
-					Group: gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
-					Kind:  "Server",
-					Name:  gatewayapiv1alpha2.ObjectName(server.Name),
-				},
-				RequiredAuthenticationRefs: []gatewayapiv1alpha2.PolicyTargetReference{
-					{
-						Group:     gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
-						Kind:      "NetworkAuthentication",
-						Name:      ingressNetworkAuthenticationName,
-						Namespace: &ingressNamespace,
+					RequiredAuthenticationRefs: []gatewayapiv1alpha2.PolicyTargetReference{
+						{
+							Group:     gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
+							Kind:      "MeshTLSAuthentication",
+							Name:      gatewayapiv1alpha2.ObjectName(grantMeshTLSAuthenticationName(allowedProject)),
+							Namespace: &project,
+						},
 					},
 				},
-			},
-		})
+			})
+		}
 
-		if len(networks) > 0 {
+		if routerAuthenticationRef != nil {
 			resp.Objects(&policyv1alpha1.AuthorizationPolicy{
 				ObjectMeta: metav1.ObjectMeta{
 					Namespace: server.Namespace,
@@ -322,41 +423,92 @@ func (h Handler) AddAuthorizationPolicy(req router.Request, resp router.Response
 						Name:  gatewayapiv1alpha2.ObjectName(server.Name),
 					},
 					RequiredAuthenticationRefs: []gatewayapiv1alpha2.PolicyTargetReference{
-						{
-							Group:     gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
-							Kind:      "NetworkAuthentication",
-							Name:      gatewayapiv1alpha2.ObjectName(name.SafeConcatName(routerNetworkAuthenticationName, projectNamespace.Name)),
-							Namespace: &project,
-						},
+						*routerAuthenticationRef,
 					},
 				},
 			})
 		}
+
+		// Check if service is referenced by an ingress, and if so, create an authorization policy that
+		// allow traffic from ingress pod
+		ingressClasses := backends.exposes(server)
+		if ingressClasses == nil {
+			continue
+		}
+
+		for _, ingressEndpoint := range ingressEndpoints {
+			if ingressEndpoint.serves(ingressClasses) {
+				resp.Objects(ingressEndpoint.authorizationPolicy(&server))
+			}
+		}
+	}
+
+	// The same project boundary is enforced by NetworkPolicies, which also covers pods and traffic that bypass the proxy.
+	// Permissive isolation allows meshed workloads that NetworkPolicies can't tell apart.
+	if h.networkPolicies && mode == isolationStrict {
+		var grantedProjects []string
+		for grantedProject, ok := range grants {
+			if ok {
+				grantedProjects = append(grantedProjects, grantedProject)
+			}
+		}
+		sort.Strings(grantedProjects)
+
+		for _, networkPolicy := range projectNetworkPolicies(projectNamespace.Name, appNamespaces, grantedProjects, ingressEndpoints) {
+			resp.Objects(networkPolicy)
+		}
 	}
 
 	return nil
 }
 
-// ConfigureNetworkAuthorizationForIngress configures the authorization policy so that
-// Ingress pod is able to reach acorn apps. This should normally be done through service
-// account identity but not sure why it is not working.
-// TODO: need to figure out how service account works when ingress mode is enabled
+// ConfigureNetworkAuthorizationForIngress configures the authentication that the ingress authorization policies refer
+// to, so that Ingress pod is able to reach acorn apps. When the ingress controller is meshed, its service account
+// identities are used. Otherwise, the pod IPs from the EndpointSlices of the ingress controller Service are allowed
+// through a NetworkAuthentication.
 func (h Handler) ConfigureNetworkAuthorizationForIngress(req router.Request, resp router.Response) error {
-	ingressEndpoint := req.Object.(*corev1.Endpoints)
+	service := req.Object.(*corev1.Service)
 
-	var networks []*policyv1alpha1.Network
-	for _, subnet := range ingressEndpoint.Subsets {
-		for _, address := range subnet.Addresses {
-			networks = append(networks, &policyv1alpha1.Network{
-				Cidr: address.IP,
-			})
+	ingressEndpoint, ok, err := h.ingressEndpointFor(req, service)
+	if err != nil || !ok {
+		return err
+	}
+
+	slices, err := listEndpointSlices(req, service.Namespace, service.Name)
+	if err != nil {
+		return err
+	}
+
+	trustDomain, err := h.trustDomain(req)
+	if err != nil {
+		return err
+	}
+
+	if ingressEndpoint.AuthMode == IngressAuthModeIdentity {
+		serviceAccounts, err := ingressServiceAccounts(req, slices)
+		if err != nil {
+			return err
+		}
+		if len(serviceAccounts) == 0 {
+			return nil
 		}
+
+		resp.Objects(&policyv1alpha1.MeshTLSAuthentication{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: service.Namespace,
+				Name:      ingressEndpoint.authenticationName(),
+			},
+			Spec: h.meshTLSAuthenticationSpec(serviceAccounts, trustDomain),
+		})
+		return nil
 	}
 
+	networks := networksForAddresses(endpointSliceAddresses(slices), h.aggregateNetworks)
+
 	resp.Objects(&policyv1alpha1.NetworkAuthentication{
 		ObjectMeta: metav1.ObjectMeta{
-			Namespace: ingressEndpoint.Namespace,
-			Name:      ingressNetworkAuthenticationName,
+			Namespace: service.Namespace,
+			Name:      ingressEndpoint.authenticationName(),
 		},
 		Spec: policyv1alpha1.NetworkAuthenticationSpec{
 			Networks: networks,
@@ -381,11 +533,21 @@ func (h Handler) ConfigureNetworkPolicyForBuildServer(req router.Request, resp r
 			builderDeployment.Spec.Template.Annotations = map[string]string{}
 		}
 		builderDeployment.Spec.Template.Annotations[serviceMeshAnnotation] = "enabled"
+		// mark the deployment so that uninstall knows the inject annotation was added by the plugin
+		if builderDeployment.Annotations == nil {
+			builderDeployment.Annotations = map[string]string{}
+		}
+		builderDeployment.Annotations[injectedAnnotation] = "true"
 		if err := req.Client.Update(req.Ctx, builderDeployment); err != nil {
 			return err
 		}
 	}
 
+	ingressEndpoints, err := h.ingressEndpoints(req)
+	if err != nil {
+		return err
+	}
+
 	var builderService corev1.Service
 	if err := req.Client.Get(req.Ctx, client.ObjectKey{
 		Namespace: builderDeployment.Namespace,
@@ -394,8 +556,6 @@ func (h Handler) ConfigureNetworkPolicyForBuildServer(req router.Request, resp r
 		return err
 	}
 
-	ingressNamespace := gatewayapiv1alpha2.Namespace(h.ingressEndpointNamespace)
-
 	for _, port := range builderService.Spec.Ports {
 		server := &serverv1beta1.Server{
 			ObjectMeta: metav1.ObjectMeta{
@@ -407,34 +567,34 @@ func (h Handler) ConfigureNetworkPolicyForBuildServer(req router.Request, resp r
 				},
 			},
 			Spec: serverv1beta1.ServerSpec{
-				PodSelector: metav1.SetAsLabelSelector(builderService.Spec.Selector),
-				Port:        intstr.FromInt(int(port.Port)),
+				PodSelector:   metav1.SetAsLabelSelector(builderService.Spec.Selector),
+				Port:          intstr.FromInt(int(port.Port)),
+				ProxyProtocol: proxyProtocol(&builderService, port),
 			},
 		}
 		resp.Objects(server)
 
-		resp.Objects(&policyv1alpha1.AuthorizationPolicy{
-			ObjectMeta: metav1.ObjectMeta{
-				Namespace: server.Namespace,
-				Name:      name.SafeConcatName("authz-profile-ingress", server.Name),
-			},
-			Spec: policyv1alpha1.AuthorizationPolicySpec{
-				TargetRef: gatewayapiv1alpha2.PolicyTargetReference{
-					Group: gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
-					Kind:  "Server",
-					Name:  gatewayapiv1alpha2.ObjectName(server.Name),
-				},
-				RequiredAuthenticationRefs: []gatewayapiv1alpha2.PolicyTargetReference{
-					{
-						Group:     gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
-						Kind:      "NetworkAuthentication",
-						Name:      ingressNetworkAuthenticationName,
-						Namespace: &ingressNamespace,
-					},
-				},
-			},
-		})
+		for _, ingressEndpoint := range ingressEndpoints {
+			resp.Objects(ingressEndpoint.authorizationPolicy(server))
+		}
 	}
 
 	return nil
 }
+
+// listAppNamespaces returns all the app namespaces of a project, sorted by name
+func listAppNamespaces(req router.Request, project string) ([]corev1.Namespace, error) {
+	var appNamespaces corev1.NamespaceList
+	if err := req.Client.List(req.Ctx, &appNamespaces, &client.ListOptions{
+		LabelSelector: labels.SelectorFromSet(map[string]string{
+			appNamespaceLabel: project,
+		}),
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(appNamespaces.Items, func(i, j int) bool {
+		return appNamespaces.Items[i].Name < appNamespaces.Items[j].Name
+	})
+	return appNamespaces.Items, nil
+}
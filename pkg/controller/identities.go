@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	gatewayapiv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	policyv1alpha1 "github.com/linkerd/linkerd2/controller/gen/apis/policy/v1alpha1"
+)
+
+const (
+	// IdentityRefsAuto uses identityRefs if the installed MeshTLSAuthentication CRD supports them
+	IdentityRefsAuto = "auto"
+	// IdentityRefsEnabled references the ServiceAccounts and Namespaces of the identities, linkerd resolves the identities
+	IdentityRefsEnabled = "enabled"
+	// IdentityRefsDisabled builds the identity strings from the cluster domain
+	IdentityRefsDisabled = "disabled"
+
+	meshTLSAuthenticationCRDName = "meshtlsauthentications.policy.linkerd.io"
+)
+
+// serviceAccountRef references the service account of a linkerd identity. An empty name references all the service
+// accounts of the namespace.
+type serviceAccountRef struct {
+	namespace string
+	name      string
+}
+
+// identities returns the service accounts of all the given app namespaces. By default every service account of the
+// app namespaces is trusted. With per app identities only the service accounts used by the acorn managed pods of the
+// app namespaces are listed.
+func (h Handler) identities(req router.Request, appNamespaces []corev1.Namespace) ([]serviceAccountRef, error) {
+	var serviceAccounts []serviceAccountRef
+	if !h.perAppIdentities {
+		for _, appNamespace := range appNamespaces {
+			serviceAccounts = append(serviceAccounts, serviceAccountRef{namespace: appNamespace.Name})
+		}
+		return serviceAccounts, nil
+	}
+
+	selector, err := getAcornManagedSelector()
+	if err != nil {
+		return nil, err
+	}
+
+	var pods []corev1.Pod
+	for _, appNamespace := range appNamespaces {
+		var result corev1.PodList
+		if err := req.Client.List(req.Ctx, &result, &client.ListOptions{
+			Namespace:     appNamespace.Name,
+			LabelSelector: selector,
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, pod := range result.Items {
+			// completed pods don't send traffic anymore
+			if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+				continue
+			}
+			pods = append(pods, pod)
+		}
+	}
+	return podServiceAccounts(pods), nil
+}
+
+// podServiceAccounts returns the service accounts of the pods, sorted by identity and without duplicates
+func podServiceAccounts(pods []corev1.Pod) []serviceAccountRef {
+	seen := map[serviceAccountRef]bool{}
+	var result []serviceAccountRef
+	for _, pod := range pods {
+		ref := serviceAccountRef{namespace: pod.Namespace, name: podServiceAccount(pod)}
+		if !seen[ref] {
+			seen[ref] = true
+			result = append(result, ref)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name+"."+result[i].namespace < result[j].name+"."+result[j].namespace
+	})
+	return result
+}
+
+// meshTLSAuthenticationSpec returns the spec authenticating the service accounts. With identity refs linkerd resolves
+// the identities of the referenced ServiceAccounts and Namespaces itself, otherwise the identity strings are built
+// from the trust domain.
+func (h Handler) meshTLSAuthenticationSpec(serviceAccounts []serviceAccountRef, trustDomain string) policyv1alpha1.MeshTLSAuthenticationSpec {
+	var spec policyv1alpha1.MeshTLSAuthenticationSpec
+	for _, serviceAccount := range serviceAccounts {
+		if !h.identityRefs {
+			name := serviceAccount.name
+			if name == "" {
+				name = "*"
+			}
+			spec.Identities = append(spec.Identities, serviceAccountIdentity(name, serviceAccount.namespace, trustDomain))
+			continue
+		}
+
+		if serviceAccount.name == "" {
+			spec.IdentityRefs = append(spec.IdentityRefs, gatewayapiv1alpha2.PolicyTargetReference{
+				Kind: "Namespace",
+				Name: gatewayapiv1alpha2.ObjectName(serviceAccount.namespace),
+			})
+			continue
+		}
+
+		namespace := gatewayapiv1alpha2.Namespace(serviceAccount.namespace)
+		spec.IdentityRefs = append(spec.IdentityRefs, gatewayapiv1alpha2.PolicyTargetReference{
+			Kind:      "ServiceAccount",
+			Name:      gatewayapiv1alpha2.ObjectName(serviceAccount.name),
+			Namespace: &namespace,
+		})
+	}
+	return spec
+}
+
+// serviceAccountIdentity returns the linkerd identity of a service account in the trust domain
+func serviceAccountIdentity(serviceAccount, namespace, trustDomain string) string {
+	return fmt.Sprintf("%s.%s.serviceaccount.identity.linkerd.%v", serviceAccount, namespace, trustDomain)
+}
+
+// ValidateIdentityRefs checks that the identity refs mode is one of the known modes
+func ValidateIdentityRefs(mode string) error {
+	switch mode {
+	case IdentityRefsAuto, IdentityRefsEnabled, IdentityRefsDisabled:
+		return nil
+	}
+	return fmt.Errorf("invalid identity refs mode %q, must be one of %s, %s or %s", mode, IdentityRefsAuto, IdentityRefsEnabled, IdentityRefsDisabled)
+}
+
+// ResolveIdentityRefs resolves IdentityRefsAuto to IdentityRefsEnabled if a served version of the installed
+// MeshTLSAuthentication CRD has the identityRefs field, otherwise to IdentityRefsDisabled.
+func ResolveIdentityRefs(ctx context.Context, apiExtensions apiextensionsclient.Interface, mode string) (string, error) {
+	if err := ValidateIdentityRefs(mode); err != nil {
+		return "", err
+	}
+
+	if mode == IdentityRefsAuto {
+		mode = IdentityRefsDisabled
+		crd, err := apiExtensions.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, meshTLSAuthenticationCRDName, metav1.GetOptions{})
+		if err != nil {
+			logrus.Warnf("Failed to look up the %s CRD, falling back to identity strings: %v", meshTLSAuthenticationCRDName, err)
+		} else if supportsIdentityRefs(crd) {
+			mode = IdentityRefsEnabled
+		}
+	}
+
+	logrus.Infof("Using identity refs mode %s", mode)
+	return mode, nil
+}
+
+func supportsIdentityRefs(crd *apiextensionsv1.CustomResourceDefinition) bool {
+	for _, version := range crd.Spec.Versions {
+		if !version.Served || version.Schema == nil || version.Schema.OpenAPIV3Schema == nil {
+			continue
+		}
+		if spec, ok := version.Schema.OpenAPIV3Schema.Properties["spec"]; ok {
+			if _, ok := spec.Properties["identityRefs"]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
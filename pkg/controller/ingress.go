@@ -0,0 +1,393 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/acorn-io/baaah/pkg/name"
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	gatewayapiv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	policyv1alpha1 "github.com/linkerd/linkerd2/controller/gen/apis/policy/v1alpha1"
+	serverv1beta1 "github.com/linkerd/linkerd2/controller/gen/apis/server/v1beta1"
+)
+
+const (
+	// IngressAuthModeAuto picks IngressAuthModeIdentity if the ingress controller is meshed, otherwise IngressAuthModeNetwork
+	IngressAuthModeAuto = "auto"
+	// IngressAuthModeIdentity authenticates the ingress controller by the identities of its service accounts
+	IngressAuthModeIdentity = "identity"
+	// IngressAuthModeNetwork authenticates the ingress controller by the IPs of its pods
+	IngressAuthModeNetwork = "network"
+
+	proxyVersionAnnotation = "linkerd.io/proxy-version"
+)
+
+// ingressBackends is the set of service ports that are referenced as a backend by an Ingress, along with the ingress
+// classes of those Ingresses. Backends referring to a port by number are keyed by <namespace>/<service>:<port>, backends
+// referring to a port by name are keyed by the server that is programmed for that port, <namespace>/<service>-<port name>.
+type ingressBackends map[string]map[string]bool
+
+func (i ingressBackends) add(namespace, ingressClass string, backend *networkingv1.IngressServiceBackend) {
+	if backend == nil {
+		return
+	}
+	key := fmt.Sprintf("%s/%s:%d", namespace, backend.Name, backend.Port.Number)
+	if backend.Port.Name != "" {
+		key = fmt.Sprintf("%s/%s-%s", namespace, backend.Name, backend.Port.Name)
+	}
+	if i[key] == nil {
+		i[key] = map[string]bool{}
+	}
+	i[key][ingressClass] = true
+}
+
+// exposes returns the ingress classes of the Ingresses referencing the port of the server. An Ingress without an
+// ingress class is represented by an empty class name. It returns nil if the server is not referenced by any Ingress.
+func (i ingressBackends) exposes(server serverv1beta1.Server) map[string]bool {
+	serviceName := server.Labels[serviceNameLabel]
+	if serviceName == "" {
+		return nil
+	}
+
+	var result map[string]bool
+	for _, key := range []string{
+		fmt.Sprintf("%s/%s:%s", server.Namespace, serviceName, server.Spec.Port.String()),
+		fmt.Sprintf("%s/%s", server.Namespace, server.Name),
+	} {
+		for ingressClass := range i[key] {
+			if result == nil {
+				result = map[string]bool{}
+			}
+			result[ingressClass] = true
+		}
+	}
+	return result
+}
+
+// listIngressBackends returns all the service ports that are referenced by an Ingress in the given namespaces
+func listIngressBackends(req router.Request, namespaces []string) (ingressBackends, error) {
+	result := ingressBackends{}
+	for _, ns := range namespaces {
+		var ingresses networkingv1.IngressList
+		if err := req.Client.List(req.Ctx, &ingresses, &client.ListOptions{
+			Namespace: ns,
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, ingress := range ingresses.Items {
+			ingressClass := ingressClassName(ingress)
+			if ingress.Spec.DefaultBackend != nil {
+				result.add(ingress.Namespace, ingressClass, ingress.Spec.DefaultBackend.Service)
+			}
+			for _, rule := range ingress.Spec.Rules {
+				if rule.HTTP == nil {
+					continue
+				}
+				for _, path := range rule.HTTP.Paths {
+					result.add(ingress.Namespace, ingressClass, path.Backend.Service)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// IngressEndpoint identifies the Service of an ingress controller that is allowed to reach acorn apps. The pods of the
+// ingress controller are found through the EndpointSlices of that Service.
+type IngressEndpoint struct {
+	Namespace string
+	Name      string
+	// AuthMode is either IngressAuthModeIdentity or IngressAuthModeNetwork once resolved
+	AuthMode string
+
+	// ingressClass is set for ingress endpoints discovered through an IngressClass. Those only allow traffic to servers
+	// exposed by Ingresses of that class. Other ingress endpoints allow traffic to all servers exposed by an Ingress.
+	ingressClass string
+	defaultClass bool
+}
+
+func (i IngressEndpoint) String() string {
+	return i.Namespace + "/" + i.Name
+}
+
+// serves checks if the ingress controller handles Ingresses of any of the given ingress classes
+func (i IngressEndpoint) serves(ingressClasses map[string]bool) bool {
+	if i.ingressClass == "" {
+		return true
+	}
+	return ingressClasses[i.ingressClass] || i.defaultClass && ingressClasses[""]
+}
+
+// authenticationName returns the name of the authentication representing the ingress controller
+func (i IngressEndpoint) authenticationName() string {
+	if i.AuthMode == IngressAuthModeIdentity {
+		return name.SafeConcatName(ingressMeshTLSAuthenticationName, i.Name)
+	}
+	return name.SafeConcatName(ingressNetworkAuthenticationName, i.Name)
+}
+
+// authenticationRef returns the reference to the authentication representing the ingress controller
+func (i IngressEndpoint) authenticationRef() gatewayapiv1alpha2.PolicyTargetReference {
+	ingressNamespace := gatewayapiv1alpha2.Namespace(i.Namespace)
+	kind := "NetworkAuthentication"
+	if i.AuthMode == IngressAuthModeIdentity {
+		kind = "MeshTLSAuthentication"
+	}
+	return gatewayapiv1alpha2.PolicyTargetReference{
+		Group:     gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
+		Kind:      gatewayapiv1alpha2.Kind(kind),
+		Name:      gatewayapiv1alpha2.ObjectName(i.authenticationName()),
+		Namespace: &ingressNamespace,
+	}
+}
+
+// authorizationPolicy returns the AuthorizationPolicy that allows the ingress controller to reach the server
+func (i IngressEndpoint) authorizationPolicy(server *serverv1beta1.Server) *policyv1alpha1.AuthorizationPolicy {
+	return &policyv1alpha1.AuthorizationPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: server.Namespace,
+			Name:      name.SafeConcatName("authz-profile-ingress", i.Namespace, i.Name, server.Name),
+		},
+		Spec: policyv1alpha1.AuthorizationPolicySpec{
+			TargetRef: gatewayapiv1alpha2.PolicyTargetReference{
+				Group: gatewayapiv1alpha2.Group(policyv1alpha1.SchemeGroupVersion.Group),
+				Kind:  "Server",
+				Name:  gatewayapiv1alpha2.ObjectName(server.Name),
+			},
+			RequiredAuthenticationRefs: []gatewayapiv1alpha2.PolicyTargetReference{
+				i.authenticationRef(),
+			},
+		},
+	}
+}
+
+// ParseIngressEndpoints parses a comma separated list of <namespace>/<name> ingress endpoints
+func ParseIngressEndpoints(value string) ([]IngressEndpoint, error) {
+	var result []IngressEndpoint
+	for _, endpoint := range strings.Split(value, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+		namespace, name, ok := strings.Cut(endpoint, "/")
+		if !ok || namespace == "" || name == "" {
+			return nil, fmt.Errorf("invalid ingress endpoint %q, must be in the form <namespace>/<name>", endpoint)
+		}
+		result = append(result, IngressEndpoint{
+			Namespace: namespace,
+			Name:      name,
+		})
+	}
+	return result, nil
+}
+
+// ingressEndpoints returns all the ingress endpoints that are allowed to reach acorn apps, the ones that are configured
+// explicitly followed by the ones discovered through IngressClasses and the ones matching the ingress endpoint selector.
+func (h Handler) ingressEndpoints(req router.Request) ([]IngressEndpoint, error) {
+	result := append([]IngressEndpoint{}, h.ingressEndpointList...)
+
+	if h.ingressDiscovery {
+		discovered, err := h.discoverIngressEndpoints(req)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, discovered...)
+	}
+
+	if h.ingressEndpointSelector == nil {
+		return result, nil
+	}
+
+	var services corev1.ServiceList
+	if err := req.Client.List(req.Ctx, &services, &client.ListOptions{
+		LabelSelector: h.ingressEndpointSelector,
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(services.Items, func(i, j int) bool {
+		if services.Items[i].Namespace == services.Items[j].Namespace {
+			return services.Items[i].Name < services.Items[j].Name
+		}
+		return services.Items[i].Namespace < services.Items[j].Namespace
+	})
+	for i := range services.Items {
+		if h.isConfiguredIngressEndpoint(&services.Items[i]) {
+			continue
+		}
+		ingressEndpoint, err := h.selectedIngressEndpoint(req, &services.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ingressEndpoint)
+	}
+	return result, nil
+}
+
+// ingressEndpointFor returns the ingress endpoint matching the Service. It returns false if the Service doesn't belong
+// to an ingress controller.
+func (h Handler) ingressEndpointFor(req router.Request, service *corev1.Service) (IngressEndpoint, bool, error) {
+	for _, ingressEndpoint := range h.ingressEndpointList {
+		if ingressEndpoint.Namespace == service.Namespace && ingressEndpoint.Name == service.Name {
+			return ingressEndpoint, true, nil
+		}
+	}
+
+	if h.ingressEndpointSelector != nil && h.ingressEndpointSelector.Matches(labels.Set(service.Labels)) {
+		ingressEndpoint, err := h.selectedIngressEndpoint(req, service)
+		return ingressEndpoint, err == nil, err
+	}
+
+	if h.ingressDiscovery {
+		return h.discoveredIngressEndpointFor(req, service)
+	}
+
+	return IngressEndpoint{}, false, nil
+}
+
+func (h Handler) isConfiguredIngressEndpoint(service *corev1.Service) bool {
+	for _, ingressEndpoint := range h.ingressEndpointList {
+		if ingressEndpoint.Namespace == service.Namespace && ingressEndpoint.Name == service.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// selectedIngressEndpoint builds the ingress endpoint for a Service matching the ingress endpoint selector or discovered
+// through an IngressClass. Since those are found at runtime, IngressAuthModeAuto is resolved on every reconcile.
+func (h Handler) selectedIngressEndpoint(req router.Request, service *corev1.Service) (IngressEndpoint, error) {
+	authMode := h.ingressAuthMode
+	if authMode == IngressAuthModeAuto {
+		slices, err := listEndpointSlices(req, service.Namespace, service.Name)
+		if err != nil {
+			return IngressEndpoint{}, err
+		}
+		authMode, err = ingressAuthModeForPods(endpointSlicePods(slices), func(namespace, name string) (*corev1.Pod, error) {
+			var pod corev1.Pod
+			return &pod, req.Client.Get(req.Ctx, client.ObjectKey{Namespace: namespace, Name: name}, &pod)
+		})
+		if err != nil {
+			return IngressEndpoint{}, err
+		}
+	}
+
+	return IngressEndpoint{
+		Namespace: service.Namespace,
+		Name:      service.Name,
+		AuthMode:  authMode,
+	}, nil
+}
+
+// ingressServiceAccounts returns the sorted service accounts of all the pods behind the EndpointSlices
+func ingressServiceAccounts(req router.Request, slices []discoveryv1.EndpointSlice) ([]serviceAccountRef, error) {
+	var pods []corev1.Pod
+	for _, ref := range endpointSlicePods(slices) {
+		var pod corev1.Pod
+		if err := req.Client.Get(req.Ctx, client.ObjectKey{
+			Namespace: ref.Namespace,
+			Name:      ref.Name,
+		}, &pod); apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		pods = append(pods, pod)
+	}
+	return podServiceAccounts(pods), nil
+}
+
+func podServiceAccount(pod corev1.Pod) string {
+	if pod.Spec.ServiceAccountName == "" {
+		return "default"
+	}
+	return pod.Spec.ServiceAccountName
+}
+
+// isMeshed checks if the linkerd proxy has been injected into the pod
+func isMeshed(pod corev1.Pod) bool {
+	_, ok := pod.Annotations[proxyVersionAnnotation]
+	return ok
+}
+
+// ingressAuthModeForPods returns IngressAuthModeIdentity if all the pods of the ingress controller are meshed,
+// otherwise IngressAuthModeNetwork.
+func ingressAuthModeForPods(refs []corev1.ObjectReference, getPod func(namespace, name string) (*corev1.Pod, error)) (string, error) {
+	foundPod := false
+	for _, ref := range refs {
+		pod, err := getPod(ref.Namespace, ref.Name)
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if !isMeshed(*pod) {
+			logrus.Debugf("Ingress pod %s/%s is not meshed", pod.Namespace, pod.Name)
+			return IngressAuthModeNetwork, nil
+		}
+		foundPod = true
+	}
+
+	if !foundPod {
+		logrus.Debugf("No ingress pods found")
+		return IngressAuthModeNetwork, nil
+	}
+	return IngressAuthModeIdentity, nil
+}
+
+// ValidateIngressAuthMode checks that the ingress auth mode is one of the known modes
+func ValidateIngressAuthMode(mode string) error {
+	switch mode {
+	case IngressAuthModeAuto, IngressAuthModeIdentity, IngressAuthModeNetwork:
+		return nil
+	}
+	return fmt.Errorf("invalid ingress auth mode %q, must be one of %s, %s or %s", mode, IngressAuthModeAuto, IngressAuthModeIdentity, IngressAuthModeNetwork)
+}
+
+// ResolveIngressAuthModes sets the auth mode of each configured ingress endpoint. For IngressAuthModeAuto it looks up the
+// pods of the ingress endpoint and picks IngressAuthModeIdentity if all of them are meshed, otherwise IngressAuthModeNetwork.
+func ResolveIngressAuthModes(ctx context.Context, k8s kubernetes.Interface, mode string, ingressEndpoints []IngressEndpoint) ([]IngressEndpoint, error) {
+	if err := ValidateIngressAuthMode(mode); err != nil {
+		return nil, err
+	}
+
+	result := make([]IngressEndpoint, 0, len(ingressEndpoints))
+	for _, ingressEndpoint := range ingressEndpoints {
+		ingressEndpoint.AuthMode = mode
+		if mode == IngressAuthModeAuto {
+			slices, err := k8s.DiscoveryV1().EndpointSlices(ingressEndpoint.Namespace).List(ctx, metav1.ListOptions{
+				LabelSelector: discoveryv1.LabelServiceName + "=" + ingressEndpoint.Name,
+			})
+			if err == nil && len(slices.Items) == 0 {
+				_, err = k8s.CoreV1().Services(ingressEndpoint.Namespace).Get(ctx, ingressEndpoint.Name, metav1.GetOptions{})
+			}
+			if err != nil {
+				logrus.Warnf("Failed to look up ingress endpoint %s, falling back to %s ingress auth mode: %v", ingressEndpoint, IngressAuthModeNetwork, err)
+				ingressEndpoint.AuthMode = IngressAuthModeNetwork
+			} else {
+				ingressEndpoint.AuthMode, err = ingressAuthModeForPods(endpointSlicePods(slices.Items), func(namespace, name string) (*corev1.Pod, error) {
+					return k8s.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		logrus.Infof("Using %s ingress auth mode for ingress endpoint %s", ingressEndpoint.AuthMode, ingressEndpoint)
+		result = append(result, ingressEndpoint)
+	}
+	return result, nil
+}
@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// ingressClassAnnotation is the deprecated way of setting the ingress class of an Ingress
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+	// ingressEndpointAnnotation can be set on an IngressClass to point to the <namespace>/<name> Service of the
+	// ingress controller, for controllers that can't be discovered through their labels
+	ingressEndpointAnnotation = "acorn.io/ingress-endpoint"
+)
+
+// knownIngressControllers maps the controller of an IngressClass to the labels of the Service that the standard
+// installation of that controller creates.
+var knownIngressControllers = map[string]labels.Set{
+	"traefik.io/ingress-controller": {
+		"app.kubernetes.io/name": "traefik",
+	},
+	"k8s.io/ingress-nginx": {
+		"app.kubernetes.io/name":      "ingress-nginx",
+		"app.kubernetes.io/component": "controller",
+	},
+}
+
+// ingressClassName returns the ingress class of the Ingress, or an empty string if it uses the default ingress class
+func ingressClassName(ingress networkingv1.Ingress) string {
+	if ingress.Spec.IngressClassName != nil {
+		return *ingress.Spec.IngressClassName
+	}
+	return ingress.Annotations[ingressClassAnnotation]
+}
+
+// ingressControllerMatcher identifies the Service of the controller of an IngressClass, either by namespace and name
+// or by a label selector.
+type ingressControllerMatcher struct {
+	ingressClass string
+	defaultClass bool
+	namespace    string
+	name         string
+	selector     labels.Selector
+}
+
+func (m ingressControllerMatcher) matches(service *corev1.Service) bool {
+	if m.name != "" {
+		return m.namespace == service.Namespace && m.name == service.Name
+	}
+	return m.selector.Matches(labels.Set(service.Labels))
+}
+
+// ingressControllerMatchers returns how to find the ingress controller of each IngressClass in the cluster, sorted by
+// ingress class name. IngressClasses whose controller is unknown are skipped.
+func ingressControllerMatchers(req router.Request) ([]ingressControllerMatcher, error) {
+	var ingressClasses networkingv1.IngressClassList
+	if err := req.Client.List(req.Ctx, &ingressClasses, &client.ListOptions{}); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(ingressClasses.Items, func(i, j int) bool {
+		return ingressClasses.Items[i].Name < ingressClasses.Items[j].Name
+	})
+
+	var result []ingressControllerMatcher
+	for _, ingressClass := range ingressClasses.Items {
+		matcher := ingressControllerMatcher{
+			ingressClass: ingressClass.Name,
+			defaultClass: ingressClass.Annotations[networkingv1.AnnotationIsDefaultIngressClass] == "true",
+		}
+
+		if endpoint := ingressClass.Annotations[ingressEndpointAnnotation]; endpoint != "" {
+			namespace, name, ok := strings.Cut(endpoint, "/")
+			if !ok || namespace == "" || name == "" {
+				logrus.Warnf("Ignoring invalid %s annotation %q on ingress class %s, must be in the form <namespace>/<name>", ingressEndpointAnnotation, endpoint, ingressClass.Name)
+				continue
+			}
+			matcher.namespace, matcher.name = namespace, name
+		} else if set, ok := knownIngressControllers[ingressClass.Spec.Controller]; ok {
+			matcher.selector = set.AsSelector()
+		} else if ingressClass.Labels["app.kubernetes.io/name"] != "" && ingressClass.Labels["app.kubernetes.io/instance"] != "" {
+			// IngressClasses installed by helm charts share the name and instance labels with the controller service
+			matcher.selector = labels.SelectorFromSet(map[string]string{
+				"app.kubernetes.io/name":     ingressClass.Labels["app.kubernetes.io/name"],
+				"app.kubernetes.io/instance": ingressClass.Labels["app.kubernetes.io/instance"],
+			})
+		} else {
+			logrus.Debugf("Unable to discover the controller of ingress class %s", ingressClass.Name)
+			continue
+		}
+
+		result = append(result, matcher)
+	}
+
+	return result, nil
+}
+
+// discoverIngressEndpoints returns the Services of the controllers of all the IngressClasses in the cluster
+func (h Handler) discoverIngressEndpoints(req router.Request) ([]IngressEndpoint, error) {
+	matchers, err := ingressControllerMatchers(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []IngressEndpoint
+	for _, matcher := range matchers {
+		var services []corev1.Service
+		if matcher.name != "" {
+			var service corev1.Service
+			if err := req.Client.Get(req.Ctx, client.ObjectKey{
+				Namespace: matcher.namespace,
+				Name:      matcher.name,
+			}, &service); apierrors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			services = append(services, service)
+		} else {
+			var list corev1.ServiceList
+			if err := req.Client.List(req.Ctx, &list, &client.ListOptions{
+				LabelSelector: matcher.selector,
+			}); err != nil {
+				return nil, err
+			}
+			sort.Slice(list.Items, func(i, j int) bool {
+				return list.Items[i].Namespace+"/"+list.Items[i].Name < list.Items[j].Namespace+"/"+list.Items[j].Name
+			})
+			services = list.Items
+		}
+
+		for i := range services {
+			ingressEndpoint, err := h.selectedIngressEndpoint(req, &services[i])
+			if err != nil {
+				return nil, err
+			}
+			ingressEndpoint.ingressClass = matcher.ingressClass
+			ingressEndpoint.defaultClass = matcher.defaultClass
+			result = append(result, ingressEndpoint)
+		}
+	}
+
+	return result, nil
+}
+
+// discoveredIngressEndpointFor returns the ingress endpoint if the Service belongs to the controller of an IngressClass
+func (h Handler) discoveredIngressEndpointFor(req router.Request, service *corev1.Service) (IngressEndpoint, bool, error) {
+	matchers, err := ingressControllerMatchers(req)
+	if err != nil {
+		return IngressEndpoint{}, false, err
+	}
+
+	for _, matcher := range matchers {
+		if !matcher.matches(service) {
+			continue
+		}
+		ingressEndpoint, err := h.selectedIngressEndpoint(req, service)
+		if err != nil {
+			return IngressEndpoint{}, false, err
+		}
+		ingressEndpoint.ingressClass = matcher.ingressClass
+		ingressEndpoint.defaultClass = matcher.defaultClass
+		return ingressEndpoint, true, nil
+	}
+
+	return IngressEndpoint{}, false, nil
+}
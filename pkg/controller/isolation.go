@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// isolationAnnotation is set on a project namespace to select how the apps of the project are isolated
+	isolationAnnotation = "acorn.io/linkerd-isolation"
+
+	// isolationStrict only allows traffic from the apps of the project, granted projects, the router and ingress
+	isolationStrict = "strict"
+	// isolationPermissive allows traffic from any meshed workload of the cluster
+	isolationPermissive = "permissive"
+	// isolationOff doesn't create Servers or policies for the project and removes the ones that exist
+	isolationOff = "off"
+
+	defaultInboundPolicyAnnotation = "config.linkerd.io/default-inbound-policy"
+	// defaultInboundPolicyAudit was set on projects by previous versions of the plugin for audit isolation, it is removed
+	// again since the default inbound policy audits against denying all traffic instead of the policies of the project
+	defaultInboundPolicyAudit = "audit"
+
+	// linkerdAnnotation set to disabled on a project namespace opts the project out of the mesh
+	linkerdAnnotation = "acorn.io/linkerd"
+)
+
+// meshDisabled checks if the project opted out of the mesh, either through the linkerd annotation or by explicitly
+// disabling injection
+func meshDisabled(projectNamespace *corev1.Namespace) bool {
+	return projectNamespace.Annotations[linkerdAnnotation] == "disabled" ||
+		projectNamespace.Annotations[serviceMeshAnnotation] == "disabled"
+}
+
+// isolationMode returns the isolation mode of the project. Unknown modes fall back to strict isolation. Projects that
+// opted out of the mesh are not isolated either, so that their Servers and policies are removed.
+func isolationMode(projectNamespace *corev1.Namespace) string {
+	if meshDisabled(projectNamespace) {
+		return isolationOff
+	}
+
+	mode, ok := projectNamespace.Annotations[isolationAnnotation]
+	if !ok {
+		return isolationStrict
+	}
+
+	switch mode {
+	case isolationStrict, isolationPermissive, isolationOff:
+		return mode
+	}
+	logrus.Warnf("Ignoring invalid %s annotation %q on project %s, using %s isolation", isolationAnnotation, mode, projectNamespace.Name, isolationStrict)
+	return isolationStrict
+}
+
+// projectIsolationMode returns the isolation mode of the project by name. Objects that don't name their project are
+// strictly isolated, while the objects of a namespace that doesn't exist or is no longer a project are not isolated.
+func projectIsolationMode(req router.Request, project string) (string, error) {
+	if project == "" {
+		return isolationStrict, nil
+	}
+
+	var projectNamespace corev1.Namespace
+	if err := req.Client.Get(req.Ctx, client.ObjectKey{Name: project}, &projectNamespace); apierrors.IsNotFound(err) {
+		return isolationOff, nil
+	} else if err != nil {
+		return "", err
+	}
+	if !projectSelector.Matches(labels.Set(projectNamespace.Labels)) || !projectNamespace.DeletionTimestamp.IsZero() {
+		return isolationOff, nil
+	}
+	return isolationMode(&projectNamespace), nil
+}
@@ -0,0 +1,118 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/acorn-io/baaah/pkg/apply"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	policyv1alpha1 "github.com/linkerd/linkerd2/controller/gen/apis/policy/v1alpha1"
+)
+
+const (
+	// migrationsAnnotation records the comma separated migrations that ran on the cluster on the acorn-system namespace
+	migrationsAnnotation = "acorn.io/linkerd-plugin-migrations"
+
+	// ingressServiceOwnerMigration releases the ingress authentications owned by the Endpoints of ingress controllers
+	ingressServiceOwnerMigration = "ingress-service-owner"
+)
+
+// migrate runs the migrations that didn't run on the cluster yet and records them on the acorn-system namespace, so
+// that each runs once. A failed migration is logged and tried again on the next start, it doesn't keep the controller
+// from starting.
+func migrate(ctx context.Context, c client.Client) {
+	var namespace corev1.Namespace
+	if err := c.Get(ctx, client.ObjectKey{Name: acornSystemNamespace}, &namespace); apierrors.IsNotFound(err) {
+		// without acorn there is nothing the plugin created before
+		return
+	} else if err != nil {
+		logrus.Warnf("Failed to look up the migrations of the plugin: %v", err)
+		return
+	}
+
+	done := map[string]bool{}
+	for _, migration := range strings.Split(namespace.Annotations[migrationsAnnotation], ",") {
+		done[migration] = migration != ""
+	}
+	if done[ingressServiceOwnerMigration] {
+		return
+	}
+
+	logs := logrus.StandardLogger().Writer()
+	defer logs.Close()
+	if err := releaseIngressEndpoints(ctx, c, false, logs); err != nil {
+		logrus.Warnf("Failed to run migration %s: %v", ingressServiceOwnerMigration, err)
+		return
+	}
+
+	migrations := []string{ingressServiceOwnerMigration}
+	if existing := namespace.Annotations[migrationsAnnotation]; existing != "" {
+		migrations = append([]string{existing}, migrations...)
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				migrationsAnnotation: strings.Join(migrations, ","),
+			},
+		},
+	})
+	if err == nil {
+		err = c.Patch(ctx, &namespace, client.RawPatch(types.MergePatchType, patch))
+	}
+	if err != nil {
+		logrus.Warnf("Failed to record migration %s: %v", ingressServiceOwnerMigration, err)
+	}
+}
+
+// releaseIngressEndpoints deletes the ingress authentications that previous versions of the plugin created for the
+// Endpoints of the ingress controllers. They have the same per controller names as the ones that are now created for
+// the Service of the ingress controller, which apply can't take over while they are owned by the Endpoints. They
+// predate the managed by label, so they are found by the owner that apply recorded on them.
+func releaseIngressEndpoints(ctx context.Context, c client.Client, dryRun bool, out io.Writer) error {
+	action := "Deleted"
+	if dryRun {
+		action = "Would delete"
+	}
+
+	endpointsGVK := corev1.SchemeGroupVersion.WithKind("Endpoints").String()
+	for _, list := range []client.ObjectList{
+		&policyv1alpha1.MeshTLSAuthenticationList{},
+		&policyv1alpha1.NetworkAuthenticationList{},
+	} {
+		if err := c.List(ctx, list); err != nil {
+			return err
+		}
+
+		objs, err := meta.ExtractList(list)
+		if err != nil {
+			return err
+		}
+		for _, o := range objs {
+			obj := o.(client.Object)
+			if obj.GetAnnotations()[apply.LabelGVK] != endpointsGVK {
+				continue
+			}
+			gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+			if err != nil {
+				return err
+			}
+			if !dryRun {
+				if err := c.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(out, "%s %s %s/%s\n", action, gvk.Kind, obj.GetNamespace(), obj.GetName())
+		}
+	}
+	return nil
+}
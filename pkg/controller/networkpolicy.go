@@ -0,0 +1,97 @@
+package controller
+
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	projectNetworkPolicyName = "acorn-project-isolation"
+
+	// namespaceNameLabel is set on every namespace by kubernetes
+	namespaceNameLabel = "kubernetes.io/metadata.name"
+
+	linkerdControlPlaneLabel = "linkerd.io/is-control-plane"
+	linkerdExtensionLabel    = "linkerd.io/extension"
+)
+
+// namespacePeer returns a peer matching all the pods of the namespace
+func namespacePeer(namespace string) networkingv1.NetworkPolicyPeer {
+	return networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: metav1.SetAsLabelSelector(map[string]string{
+			namespaceNameLabel: namespace,
+		}),
+	}
+}
+
+// projectNetworkPolicies returns the NetworkPolicies that enforce the boundary of a strictly isolated project at L3/L4,
+// independent of the linkerd proxy. Each app namespace of the project only accepts traffic from the app namespaces of
+// the project and of the granted projects, from acorn-system where the router runs, from the namespaces of the ingress
+// controllers and from the linkerd control plane and its extensions.
+func projectNetworkPolicies(project string, appNamespaces []corev1.Namespace, grantedProjects []string, ingressEndpoints []IngressEndpoint) []*networkingv1.NetworkPolicy {
+	peers := []networkingv1.NetworkPolicyPeer{
+		{
+			NamespaceSelector: metav1.SetAsLabelSelector(map[string]string{
+				appNamespaceLabel: project,
+			}),
+		},
+	}
+	for _, grantedProject := range grantedProjects {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: metav1.SetAsLabelSelector(map[string]string{
+				appNamespaceLabel: grantedProject,
+			}),
+		})
+	}
+
+	namespaces := map[string]bool{acornSystemNamespace: true}
+	for _, ingressEndpoint := range ingressEndpoints {
+		namespaces[ingressEndpoint.Namespace] = true
+	}
+	sortedNamespaces := make([]string, 0, len(namespaces))
+	for namespace := range namespaces {
+		sortedNamespaces = append(sortedNamespaces, namespace)
+	}
+	sort.Strings(sortedNamespaces)
+	for _, namespace := range sortedNamespaces {
+		peers = append(peers, namespacePeer(namespace))
+	}
+
+	peers = append(peers,
+		networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: metav1.SetAsLabelSelector(map[string]string{
+				linkerdControlPlaneLabel: "true",
+			}),
+		},
+		networkingv1.NetworkPolicyPeer{
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{
+					{Key: linkerdExtensionLabel, Operator: metav1.LabelSelectorOpExists},
+				},
+			},
+		},
+	)
+
+	var result []*networkingv1.NetworkPolicy
+	for _, appNamespace := range appNamespaces {
+		result = append(result, &networkingv1.NetworkPolicy{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: appNamespace.Name,
+				Name:      projectNetworkPolicyName,
+			},
+			Spec: networkingv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{},
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				Ingress: []networkingv1.NetworkPolicyIngressRule{
+					{
+						From: peers,
+					},
+				},
+			},
+		})
+	}
+	return result
+}
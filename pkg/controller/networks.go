@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"net/netip"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+
+	policyv1alpha1 "github.com/linkerd/linkerd2/controller/gen/apis/policy/v1alpha1"
+)
+
+// podIPs returns the IPs of every IP family of the pod. Clusters that don't populate podIPs only report the primary IP.
+func podIPs(pod corev1.Pod) []string {
+	if len(pod.Status.PodIPs) == 0 {
+		if pod.Status.PodIP == "" {
+			return nil
+		}
+		return []string{pod.Status.PodIP}
+	}
+
+	result := make([]string, 0, len(pod.Status.PodIPs))
+	for _, ip := range pod.Status.PodIPs {
+		result = append(result, ip.IP)
+	}
+	return result
+}
+
+// hostPrefix returns the single host network of the address, a /32 for IPv4 or a /128 for IPv6
+func hostPrefix(address string) (netip.Prefix, bool) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		logrus.Warnf("Ignoring invalid IP address %q", address)
+		return netip.Prefix{}, false
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+// networksForAddresses returns the networks that cover exactly the given addresses, sorted with IPv4 before IPv6. Every
+// address becomes a host network unless aggregate is set, in which case contiguous addresses are merged into the
+// widest prefixes that don't cover any other address.
+func networksForAddresses(addresses []string, aggregate bool) []*policyv1alpha1.Network {
+	seen := map[netip.Prefix]bool{}
+	var prefixes []netip.Prefix
+	for _, address := range addresses {
+		prefix, ok := hostPrefix(address)
+		if !ok || seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		prefixes = append(prefixes, prefix)
+	}
+
+	sort.Slice(prefixes, func(i, j int) bool {
+		return prefixes[i].Addr().Less(prefixes[j].Addr())
+	})
+
+	if aggregate {
+		prefixes = aggregatePrefixes(prefixes)
+	}
+
+	var networks []*policyv1alpha1.Network
+	for _, prefix := range prefixes {
+		networks = append(networks, &policyv1alpha1.Network{
+			Cidr: prefix.String(),
+		})
+	}
+	return networks
+}
+
+// aggregatePrefixes merges sorted host prefixes. Whenever the two last prefixes are the two halves of the same parent
+// prefix they are replaced by that parent, which is repeated until no more halves can be merged.
+func aggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	var result []netip.Prefix
+	for _, prefix := range prefixes {
+		result = append(result, prefix)
+		for len(result) > 1 {
+			last, previous := result[len(result)-1], result[len(result)-2]
+			if last.Bits() != previous.Bits() || last.Bits() == 0 {
+				break
+			}
+			parent := netip.PrefixFrom(previous.Addr(), previous.Bits()-1).Masked()
+			if parent.Addr() != previous.Addr() || !parent.Contains(last.Addr()) {
+				break
+			}
+			result = append(result[:len(result)-2], parent)
+		}
+	}
+	return result
+}
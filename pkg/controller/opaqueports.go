@@ -0,0 +1,240 @@
+package controller
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	opaquePortsAnnotation = "config.linkerd.io/opaque-ports"
+
+	// opaquePortsSetAnnotation records the opaque ports that the plugin set, so that opaque ports configured otherwise
+	// are left as is
+	opaquePortsSetAnnotation = "acorn.io/linkerd-opaque-ports"
+
+	// linkerdDefaultOpaquePorts are the opaque ports of a linkerd control plane that doesn't configure them
+	linkerdDefaultOpaquePorts = "25,587,3306,4444,5432,6379,9300,11211"
+)
+
+// serverFirstPorts are the well known ports of protocols that linkerd can't detect: the default opaque ports of linkerd
+// (SMTP, MySQL, Galera, PostgreSQL, Redis, Elasticsearch, Memcached) and Kafka
+var serverFirstPorts = map[int32]bool{
+	25:    true,
+	587:   true,
+	3306:  true,
+	4444:  true,
+	5432:  true,
+	6379:  true,
+	9092:  true,
+	9300:  true,
+	11211: true,
+}
+
+// isOpaquePort checks if linkerd should proxy the traffic of the port without detecting its protocol. A protocol that
+// is set for the port through the proxy protocol annotation, its app protocol or its name wins, otherwise TCP ports and
+// the well known ports of server first protocols are opaque.
+func isOpaquePort(service *corev1.Service, port corev1.ServicePort) bool {
+	if protocol := proxyProtocol(service, port); protocol != "" {
+		return protocol == proxyProtocolOpaque
+	}
+	if port.AppProtocol != nil && strings.EqualFold(*port.AppProtocol, "tcp") {
+		return true
+	}
+	return serverFirstPorts[port.Port]
+}
+
+// formatPorts returns the ports as sorted, comma separated list without duplicates
+func formatPorts(ports []int32) string {
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i] < ports[j]
+	})
+
+	var result []string
+	for i, port := range ports {
+		if i > 0 && ports[i-1] == port {
+			continue
+		}
+		result = append(result, strconv.Itoa(int(port)))
+	}
+	return strings.Join(result, ",")
+}
+
+// serviceOpaquePorts returns the opaque ports of the service
+func serviceOpaquePorts(service *corev1.Service) string {
+	var ports []int32
+	for _, port := range service.Spec.Ports {
+		if isOpaquePort(service, port) {
+			ports = append(ports, port.Port)
+		}
+	}
+	return formatPorts(ports)
+}
+
+// workloadOpaquePorts returns the container ports behind the opaque ports of the services. Ports that target a named
+// container port can't be resolved without the pods and are left out.
+func workloadOpaquePorts(services []corev1.Service) string {
+	var ports []int32
+	for i := range services {
+		for _, port := range services[i].Spec.Ports {
+			if !isOpaquePort(&services[i], port) {
+				continue
+			}
+			switch {
+			case port.TargetPort.Type == intstr.Int && port.TargetPort.IntVal != 0:
+				ports = append(ports, port.TargetPort.IntVal)
+			case port.TargetPort.Type == intstr.Int:
+				// without a target port the service port is used
+				ports = append(ports, port.Port)
+			}
+		}
+	}
+	return formatPorts(ports)
+}
+
+// mergeOpaquePorts returns the opaque ports of the comma separated lists without duplicates. Single ports are sorted and
+// followed by the port ranges that linkerd allows in its configuration.
+func mergeOpaquePorts(lists ...string) string {
+	var (
+		ports  []int32
+		ranges []string
+		seen   = map[string]bool{}
+	)
+	for _, list := range lists {
+		for _, entry := range strings.Split(list, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if port, err := strconv.ParseInt(entry, 10, 32); err == nil {
+				ports = append(ports, int32(port))
+			} else if !seen[entry] {
+				seen[entry] = true
+				ranges = append(ranges, entry)
+			}
+		}
+	}
+
+	result := formatPorts(ports)
+	if len(ranges) == 0 {
+		return result
+	}
+	if result == "" {
+		return strings.Join(ranges, ",")
+	}
+	return result + "," + strings.Join(ranges, ",")
+}
+
+// linkerdOpaquePorts returns the opaque ports that the linkerd control plane configures for the proxies, or the
+// defaults of linkerd if they can't be found
+func linkerdOpaquePorts(req router.Request) (string, error) {
+	var configMap corev1.ConfigMap
+	if err := req.Client.Get(req.Ctx, client.ObjectKey{
+		Namespace: linkerdNamespace,
+		Name:      linkerdConfigName,
+	}, &configMap); apierrors.IsNotFound(err) {
+		return linkerdDefaultOpaquePorts, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if values, ok := parseLinkerdValues(&configMap); ok && values.Proxy != nil && values.Proxy.OpaquePorts != "" {
+		return values.Proxy.OpaquePorts, nil
+	}
+	return linkerdDefaultOpaquePorts, nil
+}
+
+// setOpaquePorts updates the opaque ports annotation of the object and returns whether it changed. The annotation is
+// only changed if it isn't set or was set by the plugin.
+func setOpaquePorts(obj client.Object, ports string) bool {
+	annotations := obj.GetAnnotations()
+	current := annotations[opaquePortsAnnotation]
+	recorded, ok := annotations[opaquePortsSetAnnotation]
+	if current != "" && (!ok || current != recorded) {
+		return false
+	}
+
+	if ports == "" {
+		if !ok {
+			return false
+		}
+		delete(annotations, opaquePortsAnnotation)
+		delete(annotations, opaquePortsSetAnnotation)
+		obj.SetAnnotations(annotations)
+		return true
+	}
+
+	if current == ports {
+		return false
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[opaquePortsAnnotation] = ports
+	annotations[opaquePortsSetAnnotation] = ports
+	obj.SetAnnotations(annotations)
+	return true
+}
+
+// AddOpaquePortsToService marks the ports of an acorn service that linkerd can't detect the protocol of as opaque, so
+// that clients proxy them as plain TCP. Only the annotations are patched, so that the service isn't updated from a stale
+// copy.
+func AddOpaquePortsToService(req router.Request, resp router.Response) error {
+	service := req.Object.(*corev1.Service)
+
+	ports := serviceOpaquePorts(service)
+	patched := service.DeepCopy()
+	if !setOpaquePorts(patched, ports) {
+		return nil
+	}
+
+	logrus.Infof("Updating service %s/%s to use opaque ports %q", service.Namespace, service.Name, ports)
+	return req.Client.Patch(req.Ctx, patched, client.MergeFrom(service))
+}
+
+// AddOpaquePortsToAppNamespace marks the container ports behind the opaque ports of the acorn services of an app
+// namespace as opaque on the namespace, so that it propagates to the proxies of the pods of the apps. The annotation
+// replaces the opaque ports that linkerd configures for the proxies, so those are kept in it. Like for services, only
+// the annotations are patched.
+func AddOpaquePortsToAppNamespace(req router.Request, resp router.Response) error {
+	appNamespace := req.Object.(*corev1.Namespace)
+
+	// the services are listed by namespace, so that removed services also update the namespace
+	var services corev1.ServiceList
+	if err := req.Client.List(req.Ctx, &services, &client.ListOptions{
+		Namespace: appNamespace.Name,
+	}); err != nil {
+		return err
+	}
+
+	var appServices []corev1.Service
+	for _, service := range services.Items {
+		if service.Labels[appNameLabel] != "" && service.Labels[appNamespaceLabel] != "" {
+			appServices = append(appServices, service)
+		}
+	}
+
+	ports := workloadOpaquePorts(appServices)
+	if ports != "" {
+		defaults, err := linkerdOpaquePorts(req)
+		if err != nil {
+			return err
+		}
+		ports = mergeOpaquePorts(ports, defaults)
+	}
+
+	patched := appNamespace.DeepCopy()
+	if !setOpaquePorts(patched, ports) {
+		return nil
+	}
+
+	logrus.Infof("Updating app namespace %s to use opaque ports %q", appNamespace.Name, ports)
+	return req.Client.Patch(req.Ctx, patched, client.MergeFrom(appNamespace))
+}
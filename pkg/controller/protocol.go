@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// proxyProtocolAnnotation can be set on a service to override the proxy protocol of its Servers. It is either a
+	// protocol for all the ports of the service, or a comma separated list of <port name or number>=<protocol>.
+	proxyProtocolAnnotation = "acorn.io/linkerd-proxy-protocol"
+
+	proxyProtocolUnknown = "unknown"
+	proxyProtocolHTTP1   = "HTTP/1"
+	proxyProtocolHTTP2   = "HTTP/2"
+	proxyProtocolGRPC    = "gRPC"
+	proxyProtocolOpaque  = "opaque"
+	proxyProtocolTLS     = "TLS"
+)
+
+// proxyProtocols maps the known protocol names, in lower case, to the proxy protocol of a Server. Protocols where the
+// server speaks first can't be detected by linkerd and are opaque. Acorn sets the generic http on every HTTP port, which
+// may as well serve h2c or gRPC, so it is left to the protocol detection of linkerd.
+var proxyProtocols = map[string]string{
+	"unknown":           proxyProtocolUnknown,
+	"http":              proxyProtocolUnknown,
+	"http1":             proxyProtocolHTTP1,
+	"http/1":            proxyProtocolHTTP1,
+	"http/1.1":          proxyProtocolHTTP1,
+	"http2":             proxyProtocolHTTP2,
+	"http/2":            proxyProtocolHTTP2,
+	"h2c":               proxyProtocolHTTP2,
+	"kubernetes.io/h2c": proxyProtocolHTTP2,
+	"grpc":              proxyProtocolGRPC,
+	"opaque":            proxyProtocolOpaque,
+	"tls":               proxyProtocolTLS,
+	"https":             proxyProtocolTLS,
+	"mysql":             proxyProtocolOpaque,
+	"postgres":          proxyProtocolOpaque,
+	"postgresql":        proxyProtocolOpaque,
+	"redis":             proxyProtocolOpaque,
+	"memcached":         proxyProtocolOpaque,
+	"smtp":              proxyProtocolOpaque,
+}
+
+// proxyProtocol returns the proxy protocol of the Server of a service port. The annotation of the service takes
+// precedence over the app protocol of the port, which takes precedence over the port name, where a protocol can be
+// given as prefix like grpc-api or mysql. A port name can still narrow down an unknown app protocol. It returns an empty
+// string to let linkerd detect the protocol.
+func proxyProtocol(service *corev1.Service, port corev1.ServicePort) string {
+	if protocol, ok := annotatedProxyProtocol(service, port); ok {
+		return protocol
+	}
+
+	var protocol string
+	if port.AppProtocol != nil {
+		protocol = proxyProtocols[strings.ToLower(*port.AppProtocol)]
+		if protocol != "" && protocol != proxyProtocolUnknown {
+			return protocol
+		}
+	}
+
+	prefix, _, _ := strings.Cut(port.Name, "-")
+	if byName := proxyProtocols[strings.ToLower(prefix)]; byName != "" && (protocol == "" || byName != proxyProtocolUnknown) {
+		return byName
+	}
+	return protocol
+}
+
+// annotatedProxyProtocol returns the proxy protocol of the port from the proxy protocol annotation of the service
+func annotatedProxyProtocol(service *corev1.Service, port corev1.ServicePort) (string, bool) {
+	value := service.Annotations[proxyProtocolAnnotation]
+	if value == "" {
+		return "", false
+	}
+
+	var result string
+	found := false
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		portKey, name, ok := strings.Cut(entry, "=")
+		if !ok {
+			// a protocol without port applies to every port that isn't listed explicitly
+			name = entry
+		} else if portKey = strings.TrimSpace(portKey); portKey != port.Name && portKey != strconv.Itoa(int(port.Port)) {
+			continue
+		}
+
+		protocol, known := proxyProtocols[strings.ToLower(strings.TrimSpace(name))]
+		if !known {
+			logrus.Warnf("Ignoring unknown proxy protocol %q in the %s annotation of service %s/%s", name, proxyProtocolAnnotation, service.Namespace, service.Name)
+			continue
+		}
+		if ok || !found {
+			result = protocol
+			found = true
+		}
+		if ok {
+			break
+		}
+	}
+	return result, found
+}
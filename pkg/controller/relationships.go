@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var namespaceGVK = corev1.SchemeGroupVersion.WithKind("Namespace")
+
+// TriggerProjectForAppNamespace enqueues the project of an app namespace when the app namespace changes, so that the
+// identities of the project are updated. A removed namespace doesn't have labels anymore, so all projects are enqueued.
+func (h Handler) TriggerProjectForAppNamespace(req router.Request, resp router.Response) error {
+	if req.Object == nil {
+		return h.triggerAllProjects(req)
+	}
+	return h.triggerProject(req.Object.GetLabels()[appNamespaceLabel])
+}
+
+// TriggerProjectForServer enqueues the project of a Server when the Server changes. The project of a removed Server is
+// looked up from the app namespace it was in. Removed router Servers in acorn-system enqueue all projects.
+func (h Handler) TriggerProjectForServer(req router.Request, resp router.Response) error {
+	if req.Object != nil {
+		return h.triggerProject(req.Object.GetLabels()[appNamespaceLabel])
+	}
+
+	if req.Namespace == acornSystemNamespace {
+		return h.triggerAllProjects(req)
+	}
+	return h.triggerProjectOfAppNamespace(req)
+}
+
+// TriggerProjectForAppPod enqueues the project of an acorn managed pod when the pod changes, so that the service account
+// identities of the project follow the pods. The project of a removed pod is looked up from the app namespace it was in.
+func (h Handler) TriggerProjectForAppPod(req router.Request, resp router.Response) error {
+	if req.Object == nil {
+		return h.triggerProjectOfAppNamespace(req)
+	}
+
+	podLabels := req.Object.GetLabels()
+	if podLabels[appNameLabel] == "" {
+		return nil
+	}
+	return h.triggerProject(podLabels[appNamespaceLabel])
+}
+
+// triggerProjectOfAppNamespace enqueues the project of the app namespace of the request. The namespace is read without
+// the request client, so that the removed object is not enqueued again whenever the namespace changes.
+func (h Handler) triggerProjectOfAppNamespace(req router.Request) error {
+	appNamespace, err := h.client.CoreV1().Namespaces().Get(req.Ctx, req.Namespace, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// the namespace is being removed as well, which enqueues the project on its own
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return h.triggerProject(appNamespace.Labels[appNamespaceLabel])
+}
+
+// TriggerProjectForRouterPod enqueues the project of a router pod in acorn-system when the pod changes, so that the
+// router NetworkAuthentication follows the pod IPs. A removed pod doesn't have labels anymore, so all projects are
+// enqueued.
+func (h Handler) TriggerProjectForRouterPod(req router.Request, resp router.Response) error {
+	if req.Object == nil {
+		return h.triggerAllProjects(req)
+	}
+	return h.triggerProject(req.Object.GetLabels()[appNamespaceLabel])
+}
+
+func (h Handler) triggerProject(project string) error {
+	if project == "" || h.trigger == nil {
+		return nil
+	}
+	logrus.Debugf("Enqueueing project %s", project)
+	return h.trigger.Trigger(namespaceGVK, project, 0)
+}
+
+// triggerAllProjects enqueues every project. The projects are listed without the request client, which would otherwise
+// keep enqueueing the key of the removed object whenever a project changes.
+func (h Handler) triggerAllProjects(req router.Request) error {
+	projects, err := h.client.CoreV1().Namespaces().List(req.Ctx, metav1.ListOptions{
+		LabelSelector: projectSelector.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, project := range projects.Items {
+		if err := h.triggerProject(project.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
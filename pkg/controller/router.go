@@ -1,12 +1,17 @@
 package controller
 
 import (
+	"github.com/acorn-io/acorn-linkerd-plugin/pkg/scheme"
 	"github.com/acorn-io/baaah/pkg/router"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	serverv1beta1 "github.com/linkerd/linkerd2/controller/gen/apis/server/v1beta1"
 )
 
 var (
@@ -25,14 +30,13 @@ var (
 	acornImageSystemNamespace = "acorn-image-system"
 )
 
-func RegisterRoutes(router *router.Router, client kubernetes.Interface, debugImage, clusterDomain, ingressEndpointName, ingressEndpointNamespace string) error {
-	h := Handler{
-		client:                   client,
-		debugImage:               debugImage,
-		clusterDomain:            clusterDomain,
-		ingressEndpointName:      ingressEndpointName,
-		ingressEndpointNamespace: ingressEndpointNamespace,
+func RegisterRoutes(router *router.Router, opt Options) error {
+	h, err := newHandler(opt)
+	if err != nil {
+		return err
 	}
+	h.trigger = router.Backend()
+	h.recorder = newEventRecorder(opt.K8s)
 
 	managedSelector, err := getAcornManagedSelector()
 	if err != nil {
@@ -44,16 +48,73 @@ func RegisterRoutes(router *router.Router, client kubernetes.Interface, debugIma
 		return err
 	}
 
-	router.Type(&corev1.Namespace{}).Selector(projectSelector).HandlerFunc(AddAnnotations)
-	router.Type(&corev1.Pod{}).Selector(managedSelector).Selector(jobSelector).HandlerFunc(h.KillLinkerdSidecar)
-	router.Type(&corev1.Endpoints{}).Namespace(h.ingressEndpointNamespace).Name(h.ingressEndpointName).HandlerFunc(h.ConfigureNetworkAuthorizationForIngress)
-	router.Type(&corev1.Service{}).Selector(managedSelector).HandlerFunc(AddLinkerdServer)
-	router.Type(&corev1.Namespace{}).Selector(projectSelector).HandlerFunc(h.AddAuthorizationPolicy)
-	router.Type(&appsv1.Deployment{}).Namespace(acornImageSystemNamespace).HandlerFunc(h.ConfigureNetworkPolicyForBuildServer)
+	// everything the handlers apply is labeled, so that uninstall can find it
+	managed := router.Middleware(labelManagedObjects)
+
+	managed.Type(&corev1.Namespace{}).Selector(projectSelector).HandlerFunc(h.AddAnnotations)
+	managed.Type(&corev1.Pod{}).Selector(managedSelector).Selector(jobSelector).HandlerFunc(h.KillLinkerdSidecar)
+	managed.Type(&corev1.Service{}).HandlerFunc(h.ConfigureNetworkAuthorizationForIngress)
+	managed.Type(&corev1.Service{}).Selector(managedSelector).HandlerFunc(AddLinkerdServer)
+	managed.Type(&corev1.Service{}).Selector(managedSelector).HandlerFunc(AddOpaquePortsToService)
+	managed.Type(&corev1.Namespace{}).Selector(managedSelector).HandlerFunc(AddOpaquePortsToAppNamespace)
+	managed.Type(&corev1.Namespace{}).Selector(projectSelector).HandlerFunc(h.AddAuthorizationPolicy)
+	managed.Type(&corev1.Namespace{}).IncludeRemoved().HandlerFunc(h.TriggerProjectForAppNamespace)
+	managed.Type(&corev1.Namespace{}).IncludeRemoved().HandlerFunc(h.CleanupProject)
+	managed.Type(&serverv1beta1.Server{}).IncludeRemoved().HandlerFunc(h.TriggerProjectForServer)
+	managed.Type(&corev1.Pod{}).Namespace(acornSystemNamespace).IncludeRemoved().HandlerFunc(h.TriggerProjectForRouterPod)
+	if h.perAppIdentities {
+		managed.Type(&corev1.Pod{}).IncludeRemoved().HandlerFunc(h.TriggerProjectForAppPod)
+	}
+	managed.Type(&corev1.ConfigMap{}).Namespace(linkerdNamespace).Name(linkerdConfigName).HandlerFunc(h.CheckLinkerdConfig)
+	managed.Type(&appsv1.Deployment{}).Namespace(acornImageSystemNamespace).HandlerFunc(h.ConfigureNetworkPolicyForBuildServer)
 
 	return nil
 }
 
+// newHandler builds the handler from the options, the trigger and the event recorder are set by the caller
+func newHandler(opt Options) (Handler, error) {
+	h := Handler{
+		client:                    opt.K8s,
+		debugImage:                opt.DebugImage,
+		debugImagePullPolicy:      corev1.PullPolicy(opt.DebugImagePullPolicy),
+		debugImagePullSecret:      opt.DebugImagePullSecret,
+		sidecarShutdown:           opt.SidecarShutdown,
+		sidecarShutdownTimeout:    opt.SidecarShutdownTimeout,
+		sidecarShutdownEscalation: opt.SidecarShutdownEscalation,
+		clusterDomain:             opt.ClusterDomain,
+		clusterDomainOverride:     opt.ClusterDomainOverride,
+		ingressEndpointList:       opt.IngressEndpoints,
+		ingressDiscovery:          opt.IngressDiscovery,
+		ingressAuthMode:           opt.IngressAuthMode,
+		aggregateNetworks:         opt.AggregateNetworks,
+		perAppIdentities:          opt.PerAppIdentities,
+		identityRefs:              opt.IdentityRefs == IdentityRefsEnabled,
+		networkPolicies:           opt.NetworkPolicies,
+	}
+
+	if opt.IngressEndpointSelector != "" {
+		selector, err := labels.Parse(opt.IngressEndpointSelector)
+		if err != nil {
+			return Handler{}, err
+		}
+		h.ingressEndpointSelector = selector
+	}
+
+	securityContext, err := ParseShutdownSecurityContext(opt.ShutdownSecurityContext)
+	if err != nil {
+		return Handler{}, err
+	}
+	h.shutdownSecurityContext = securityContext
+	return h, nil
+}
+
+// newEventRecorder returns a recorder for the events the handlers emit about the objects they act on
+func newEventRecorder(k8s kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: k8s.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: routerName})
+}
+
 func getAcornManagedSelector() (labels.Selector, error) {
 	r1, err := labels.NewRequirement(appNameLabel, selection.Exists, nil)
 	if err != nil {
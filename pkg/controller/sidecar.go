@@ -0,0 +1,511 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/version"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// SidecarShutdownAuto picks SidecarShutdownNativeSidecar if both kubernetes and linkerd support native sidecars,
+	// otherwise SidecarShutdownEphemeralContainer
+	SidecarShutdownAuto = "auto"
+	// SidecarShutdownNativeSidecar has linkerd inject the proxy as native sidecar, which kubernetes shuts down once the
+	// other containers of a job completed. Pods that still run the proxy as regular container are handled like
+	// SidecarShutdownEphemeralContainer.
+	SidecarShutdownNativeSidecar = "native-sidecar"
+	// SidecarShutdownEphemeralContainer shuts the linkerd proxy of a completed job down from an ephemeral container
+	// running the debug image
+	SidecarShutdownEphemeralContainer = "ephemeral-container"
+
+	// nativeSidecarAnnotation has linkerd inject the proxy as native sidecar
+	nativeSidecarAnnotation = "config.alpha.linkerd.io/proxy-enable-native-sidecar"
+	// nativeSidecarSetAnnotation records that the native sidecar annotation of a project was set by the plugin, so
+	// that it is only removed again if the plugin added it
+	nativeSidecarSetAnnotation = "acorn.io/linkerd-native-sidecar"
+
+	// defaultProxyAdminPort is the port of the admin server of the linkerd proxy, unless configured otherwise
+	defaultProxyAdminPort = 4191
+	// proxyAdminPortAnnotation overrides the port of the admin server of the linkerd proxy of a pod
+	proxyAdminPortAnnotation = "config.linkerd.io/admin-port"
+	// proxyAdminListenAddrEnv is set on the linkerd proxy container to the address its admin server listens on
+	proxyAdminListenAddrEnv = "LINKERD2_PROXY_ADMIN_LISTEN_ADDR"
+
+	shutdownSidecarContainerName = "shutdown-sidecar"
+	// maxShutdownSidecarContainers caps the ephemeral shutdown containers added to a pod, which can't be removed again
+	maxShutdownSidecarContainers = 5
+
+	// SidecarShutdownEscalationNone only reports a job pod whose sidecar couldn't be shut down
+	SidecarShutdownEscalationNone = "none"
+	// SidecarShutdownEscalationDeletePod deletes a job pod whose sidecar couldn't be shut down
+	SidecarShutdownEscalationDeletePod = "delete-pod"
+	// SidecarShutdownEscalationFailJob fails the Job of a pod whose sidecar couldn't be shut down by setting its active
+	// deadline, the job controller then terminates the pod
+	SidecarShutdownEscalationFailJob = "fail-job"
+
+	// sidecarShutdownAnnotation records the attempts to shut down the sidecar of a job pod
+	sidecarShutdownAnnotation = "acorn.io/linkerd-sidecar-shutdown"
+
+	sidecarShutdownReason          = "SidecarShutdown"
+	sidecarShutdownFailedReason    = "SidecarShutdownFailed"
+	sidecarShutdownEscalatedReason = "SidecarShutdownEscalated"
+
+	sidecarShutdownInitialBackoff = 10 * time.Second
+	sidecarShutdownMaxBackoff     = 2 * time.Minute
+)
+
+// minNativeSidecarVersion is the first kubernetes version that enables native sidecars by default
+var minNativeSidecarVersion = version.MustParseGeneric("1.29.0")
+
+// ValidateSidecarShutdown checks that the sidecar shutdown strategy is one of the known strategies
+func ValidateSidecarShutdown(strategy string) error {
+	switch strategy {
+	case SidecarShutdownAuto, SidecarShutdownNativeSidecar, SidecarShutdownEphemeralContainer:
+		return nil
+	}
+	return fmt.Errorf("invalid sidecar shutdown strategy %q, must be one of %s, %s or %s", strategy,
+		SidecarShutdownAuto, SidecarShutdownNativeSidecar, SidecarShutdownEphemeralContainer)
+}
+
+// ValidateSidecarShutdownEscalation checks that the sidecar shutdown escalation is one of the known escalations
+func ValidateSidecarShutdownEscalation(escalation string) error {
+	switch escalation {
+	case SidecarShutdownEscalationNone, SidecarShutdownEscalationDeletePod, SidecarShutdownEscalationFailJob:
+		return nil
+	}
+	return fmt.Errorf("invalid sidecar shutdown escalation %q, must be one of %s, %s or %s", escalation,
+		SidecarShutdownEscalationNone, SidecarShutdownEscalationDeletePod, SidecarShutdownEscalationFailJob)
+}
+
+// ResolveSidecarShutdown resolves SidecarShutdownAuto to SidecarShutdownNativeSidecar if the API server enables native
+// sidecars and the installed linkerd can inject them, otherwise to SidecarShutdownEphemeralContainer.
+func ResolveSidecarShutdown(ctx context.Context, k8s kubernetes.Interface, strategy string) (string, error) {
+	if err := ValidateSidecarShutdown(strategy); err != nil {
+		return "", err
+	}
+
+	if strategy == SidecarShutdownAuto {
+		strategy = SidecarShutdownEphemeralContainer
+		if supportsNativeSidecars(ctx, k8s) {
+			strategy = SidecarShutdownNativeSidecar
+		}
+	}
+
+	logrus.Infof("Using sidecar shutdown strategy %s", strategy)
+	return strategy, nil
+}
+
+// supportsNativeSidecars checks the version of the API server and whether the values of the linkerd control plane
+// have the nativeSidecar setting of the proxy, which linkerd added along with native sidecar support
+func supportsNativeSidecars(ctx context.Context, k8s kubernetes.Interface) bool {
+	serverVersion, err := k8s.Discovery().ServerVersion()
+	if err != nil {
+		logrus.Warnf("Failed to look up the kubernetes version, not using native sidecars: %v", err)
+		return false
+	}
+	parsed, err := version.ParseGeneric(serverVersion.GitVersion)
+	if err != nil {
+		logrus.Warnf("Failed to parse the kubernetes version %s, not using native sidecars: %v", serverVersion.GitVersion, err)
+		return false
+	}
+	if !parsed.AtLeast(minNativeSidecarVersion) {
+		return false
+	}
+
+	configMap, err := k8s.CoreV1().ConfigMaps(linkerdNamespace).Get(ctx, linkerdConfigName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false
+	} else if err != nil {
+		logrus.Warnf("Failed to look up %s/%s, not using native sidecars: %v", linkerdNamespace, linkerdConfigName, err)
+		return false
+	}
+
+	values, ok := parseLinkerdValues(configMap)
+	return ok && values.Proxy != nil && values.Proxy.NativeSidecar != nil
+}
+
+// proxyContainer returns the linkerd proxy container of the pod, which is either named linkerd-proxy or configures the
+// admin server of a linkerd proxy. A proxy injected as native sidecar is an init container and isn't returned,
+// kubernetes shuts it down itself.
+func proxyContainer(pod *corev1.Pod) *corev1.Container {
+	for i, container := range pod.Spec.Containers {
+		if container.Name == proxySidecarContainerName {
+			return &pod.Spec.Containers[i]
+		}
+	}
+	for i, container := range pod.Spec.Containers {
+		for _, env := range container.Env {
+			if env.Name == proxyAdminListenAddrEnv {
+				return &pod.Spec.Containers[i]
+			}
+		}
+	}
+	return nil
+}
+
+// proxyAdminPort returns the port of the admin server of the linkerd proxy of the pod. The listen address configured
+// on the proxy container takes precedence over the admin port annotation of the pod.
+func proxyAdminPort(pod *corev1.Pod) int {
+	if container := proxyContainer(pod); container != nil {
+		for _, env := range container.Env {
+			if env.Name != proxyAdminListenAddrEnv {
+				continue
+			}
+			if _, port, err := net.SplitHostPort(env.Value); err == nil {
+				if result, err := strconv.Atoi(port); err == nil {
+					return result
+				}
+			}
+			logrus.Warnf("Ignoring invalid %s %q of pod %s/%s", proxyAdminListenAddrEnv, env.Value, pod.Namespace, pod.Name)
+		}
+	}
+
+	if value := pod.Annotations[proxyAdminPortAnnotation]; value != "" {
+		if result, err := strconv.Atoi(value); err == nil {
+			return result
+		}
+		logrus.Warnf("Ignoring invalid %s annotation %q of pod %s/%s", proxyAdminPortAnnotation, value, pod.Namespace, pod.Name)
+	}
+	return defaultProxyAdminPort
+}
+
+// sidecarState returns the linkerd proxy container of the pod and whether it has terminated, or nil if the pod has no
+// running proxy container
+func sidecarState(pod *corev1.Pod) (*corev1.Container, bool) {
+	container := proxyContainer(pod)
+	if container == nil {
+		return nil, false
+	}
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		if containerStatus.Name == container.Name {
+			return container, containerStatus.State.Terminated != nil
+		}
+	}
+	return nil, false
+}
+
+// sidecarShutdownProgress is stored in the sidecar shutdown annotation of a job pod
+type sidecarShutdownProgress struct {
+	Attempts  int         `json:"attempts"`
+	Started   metav1.Time `json:"started"`
+	Last      metav1.Time `json:"last"`
+	Escalated bool        `json:"escalated,omitempty"`
+}
+
+// sidecarShutdownProgressOf returns the recorded attempts to shut down the sidecar of the pod
+func sidecarShutdownProgressOf(pod *corev1.Pod) sidecarShutdownProgress {
+	var result sidecarShutdownProgress
+	if value := pod.Annotations[sidecarShutdownAnnotation]; value != "" {
+		if err := json.Unmarshal([]byte(value), &result); err != nil {
+			logrus.Warnf("Ignoring invalid %s annotation of pod %s/%s: %v", sidecarShutdownAnnotation, pod.Namespace, pod.Name, err)
+			return sidecarShutdownProgress{}
+		}
+	}
+	return result
+}
+
+// recordSidecarShutdownProgress stores the progress in the sidecar shutdown annotation of the pod. The pod is patched,
+// so that it doesn't conflict with the ephemeral containers the shutdown added.
+func (h Handler) recordSidecarShutdownProgress(ctx context.Context, pod *corev1.Pod, progress sidecarShutdownProgress) error {
+	value, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				sidecarShutdownAnnotation: string(value),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = h.client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// sidecarShutdownBackoff returns how long to wait after the given number of attempts before the sidecar is shut down
+// again
+func sidecarShutdownBackoff(attempts int) time.Duration {
+	backoff := sidecarShutdownInitialBackoff
+	for i := 1; i < attempts && backoff < sidecarShutdownMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > sidecarShutdownMaxBackoff {
+		return sidecarShutdownMaxBackoff
+	}
+	return backoff
+}
+
+// latestShutdownContainer returns the name and the status of the ephemeral shutdown container that was added to the
+// pod last. The status is nil if the kubelet didn't report it yet, the name is empty if the pod has no shutdown
+// container.
+func latestShutdownContainer(pod *corev1.Pod) (string, *corev1.ContainerStatus) {
+	var latest string
+	for _, container := range pod.Spec.EphemeralContainers {
+		if strings.HasPrefix(container.Name, shutdownSidecarContainerName) {
+			latest = container.Name
+		}
+	}
+	if latest == "" {
+		return "", nil
+	}
+
+	for i, status := range pod.Status.EphemeralContainerStatuses {
+		if status.Name == latest {
+			return latest, &pod.Status.EphemeralContainerStatuses[i]
+		}
+	}
+	return latest, nil
+}
+
+// shutdownContainerFailure describes why the latest ephemeral shutdown container of the pod failed, or returns an
+// empty string if it didn't fail
+func shutdownContainerFailure(pod *corev1.Pod) string {
+	latest, status := latestShutdownContainer(pod)
+	if status == nil {
+		return ""
+	}
+
+	switch {
+	case status.State.Waiting != nil && status.State.Waiting.Reason != "" && status.State.Waiting.Reason != "ContainerCreating":
+		return fmt.Sprintf("container %s is waiting: %s %s", latest, status.State.Waiting.Reason, status.State.Waiting.Message)
+	case status.State.Terminated != nil && status.State.Terminated.ExitCode != 0:
+		return fmt.Sprintf("container %s exited with %d: %s %s", latest, status.State.Terminated.ExitCode, status.State.Terminated.Reason, status.State.Terminated.Message)
+	}
+	return ""
+}
+
+// escalateSidecarShutdown handles a job pod whose sidecar couldn't be shut down within the sidecar shutdown timeout
+func (h Handler) escalateSidecarShutdown(ctx context.Context, pod *corev1.Pod, progress sidecarShutdownProgress) error {
+	message := fmt.Sprintf("The linkerd proxy is still running after %d attempts to shut it down", progress.Attempts)
+	logrus.Warnf("Escalating pod %s/%s with escalation %s: %s", pod.Namespace, pod.Name, h.sidecarShutdownEscalation, message)
+
+	switch h.sidecarShutdownEscalation {
+	case SidecarShutdownEscalationDeletePod:
+		h.recorder.Eventf(pod, corev1.EventTypeWarning, sidecarShutdownEscalatedReason, "%s, deleting the pod", message)
+		if err := h.client.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	case SidecarShutdownEscalationFailJob:
+		job, err := h.failJobOf(ctx, pod)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			h.recorder.Eventf(pod, corev1.EventTypeWarning, sidecarShutdownEscalatedReason, "%s, the pod doesn't belong to a Job", message)
+			break
+		}
+		h.recorder.Eventf(pod, corev1.EventTypeWarning, sidecarShutdownEscalatedReason, "%s, failing job %s", message, job.Name)
+		h.recorder.Eventf(job, corev1.EventTypeWarning, sidecarShutdownEscalatedReason, "%s of pod %s, failing the job", message, pod.Name)
+	default:
+		h.recorder.Eventf(pod, corev1.EventTypeWarning, sidecarShutdownEscalatedReason, message)
+	}
+
+	progress.Escalated = true
+	return h.recordSidecarShutdownProgress(ctx, pod, progress)
+}
+
+// failJobOf sets the active deadline of the Job owning the pod to its current age, so that the job controller fails
+// it and terminates its pods. It returns nil if the pod isn't owned by a Job.
+func (h Handler) failJobOf(ctx context.Context, pod *corev1.Pod) (*batchv1.Job, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "Job" || owner.APIVersion != batchv1.SchemeGroupVersion.String() {
+		return nil, nil
+	}
+
+	job, err := h.client.BatchV1().Jobs(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	deadline := int64(1)
+	if job.Status.StartTime != nil {
+		if age := int64(time.Since(job.Status.StartTime.Time).Seconds()); age > deadline {
+			deadline = age
+		}
+	}
+	patch, err := json.Marshal(map[string]any{
+		"spec": map[string]any{
+			"activeDeadlineSeconds": deadline,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.client.BatchV1().Jobs(pod.Namespace).Patch(ctx, job.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+}
+
+// sidecarShutdownMethod shuts down the linkerd proxy of a pod whose other containers have completed
+type sidecarShutdownMethod interface {
+	// String describes the method in logs
+	String() string
+	Shutdown(ctx context.Context, pod *corev1.Pod) error
+}
+
+// sidecarShutdownMethods returns the methods of the sidecar shutdown strategy, in the order they are tried
+func (h Handler) sidecarShutdownMethods() []sidecarShutdownMethod {
+	return []sidecarShutdownMethod{
+		ephemeralContainerShutdown{
+			client:          h.client,
+			image:           h.debugImage,
+			pullPolicy:      h.debugImagePullPolicy,
+			pullSecret:      h.debugImagePullSecret,
+			securityContext: h.shutdownSecurityContext,
+		},
+	}
+}
+
+// shutdownContainerCount returns how many ephemeral shutdown containers were added to the pod
+func shutdownContainerCount(pod *corev1.Pod) int {
+	count := 0
+	for _, container := range pod.Spec.EphemeralContainers {
+		if strings.HasPrefix(container.Name, shutdownSidecarContainerName) {
+			count++
+		}
+	}
+	return count
+}
+
+// ephemeralShutdownContainerName returns a name for a new ephemeral shutdown container, ephemeral containers can't be
+// removed or restarted, so every attempt that isn't waiting for a previous one adds one
+func ephemeralShutdownContainerName(pod *corev1.Pod) string {
+	count := shutdownContainerCount(pod)
+	if count == 0 {
+		return shutdownSidecarContainerName
+	}
+	return fmt.Sprintf("%s-%d", shutdownSidecarContainerName, count+1)
+}
+
+// ephemeralContainerShutdown launches an ephemeral container that posts to the shutdown endpoint of the admin server
+// of the linkerd proxy. Ephemeral containers pull their image with the pull secrets of the pod and can't have
+// resources. They can't be removed from the pod either, so a shutdown container that hasn't terminated yet is left to
+// finish and at most maxShutdownSidecarContainers are added.
+type ephemeralContainerShutdown struct {
+	client          kubernetes.Interface
+	image           string
+	pullPolicy      corev1.PullPolicy
+	pullSecret      string
+	securityContext *corev1.SecurityContext
+}
+
+func (e ephemeralContainerShutdown) String() string {
+	return "an ephemeral container"
+}
+
+func (e ephemeralContainerShutdown) Shutdown(ctx context.Context, pod *corev1.Pod) error {
+	proxy := proxyContainer(pod)
+	if proxy == nil {
+		return fmt.Errorf("pod %s/%s has no linkerd proxy container", pod.Namespace, pod.Name)
+	}
+
+	// the pull secrets of a pod can't be changed, without the secret the container would be stuck pulling the image
+	if e.pullSecret != "" && !hasImagePullSecret(pod, e.pullSecret) {
+		return fmt.Errorf("pod %s/%s doesn't have the image pull secret %s for image %s", pod.Namespace, pod.Name, e.pullSecret, e.image)
+	}
+
+	if latest, status := latestShutdownContainer(pod); latest != "" && (status == nil || status.State.Terminated == nil) {
+		logrus.Infof("Waiting for container %s of pod %s/%s to shut down the sidecar", latest, pod.Namespace, pod.Name)
+		return nil
+	}
+	if count := shutdownContainerCount(pod); count >= maxShutdownSidecarContainers {
+		return fmt.Errorf("pod %s/%s already has %d shutdown containers", pod.Namespace, pod.Name, count)
+	}
+
+	pullPolicy := e.pullPolicy
+	if pullPolicy == "" {
+		pullPolicy = corev1.PullAlways
+	}
+
+	// the pod is only changed through the API server, the pod of the request belongs to the cache
+	pod = pod.DeepCopy()
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, corev1.EphemeralContainer{
+		TargetContainerName: proxy.Name,
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
+			Name:            ephemeralShutdownContainerName(pod),
+			Image:           e.image,
+			ImagePullPolicy: pullPolicy,
+			Command: []string{
+				"curl",
+				"-X",
+				"POST",
+				fmt.Sprintf("http://localhost:%d/shutdown", proxyAdminPort(pod)),
+			},
+			SecurityContext: e.securityContext,
+		},
+	})
+	_, err := e.client.CoreV1().Pods(pod.Namespace).UpdateEphemeralContainers(ctx, pod.Name, pod, metav1.UpdateOptions{})
+	return err
+}
+
+// hasImagePullSecret checks if the pod pulls its images with the secret
+func hasImagePullSecret(pod *corev1.Pod, name string) bool {
+	for _, secret := range pod.Spec.ImagePullSecrets {
+		if secret.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictedSecurityContext returns the security context of the ephemeral shutdown container that complies with the
+// restricted Pod Security Standard
+func restrictedSecurityContext() *corev1.SecurityContext {
+	runAsNonRoot := true
+	runAsUser := int64(65534)
+	allowPrivilegeEscalation := false
+	readOnlyRootFilesystem := true
+	return &corev1.SecurityContext{
+		RunAsNonRoot:             &runAsNonRoot,
+		RunAsUser:                &runAsUser,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// ParseShutdownSecurityContext parses the security context of the ephemeral shutdown container from JSON. An empty
+// value returns the restricted security context.
+func ParseShutdownSecurityContext(value string) (*corev1.SecurityContext, error) {
+	if value == "" {
+		return restrictedSecurityContext(), nil
+	}
+
+	var result corev1.SecurityContext
+	if err := json.Unmarshal([]byte(value), &result); err != nil {
+		return nil, fmt.Errorf("invalid shutdown container security context: %w", err)
+	}
+	return &result, nil
+}
+
+// ValidatePullPolicy checks that the image pull policy is one of the kubernetes pull policies
+func ValidatePullPolicy(policy string) error {
+	switch corev1.PullPolicy(policy) {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+		return nil
+	}
+	return fmt.Errorf("invalid image pull policy %q, must be one of %s, %s or %s", policy, corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever)
+}
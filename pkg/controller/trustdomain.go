@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"github.com/acorn-io/baaah/pkg/router"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	linkerdNamespace  = "linkerd"
+	linkerdConfigName = "linkerd-config"
+)
+
+// linkerdValues is the part of the values of the linkerd control plane, stored in the linkerd-config ConfigMap, that
+// the plugin needs
+type linkerdValues struct {
+	IdentityTrustDomain string `json:"identityTrustDomain"`
+	Proxy               *struct {
+		NativeSidecar *bool  `json:"nativeSidecar"`
+		OpaquePorts   string `json:"opaquePorts"`
+	} `json:"proxy"`
+}
+
+// parseLinkerdValues returns the values of the linkerd-config ConfigMap and whether they could be parsed
+func parseLinkerdValues(configMap *corev1.ConfigMap) (linkerdValues, bool) {
+	var result linkerdValues
+	values := configMap.Data["values"]
+	if values == "" {
+		return result, false
+	}
+
+	if err := yaml.Unmarshal([]byte(values), &result); err != nil {
+		logrus.Warnf("Failed to parse the values of %s/%s: %v", configMap.Namespace, configMap.Name, err)
+		return result, false
+	}
+	return result, true
+}
+
+// linkerdTrustDomain returns the identity trust domain from the linkerd-config ConfigMap, or an empty string if it
+// can't be found
+func linkerdTrustDomain(configMap *corev1.ConfigMap) string {
+	values, _ := parseLinkerdValues(configMap)
+	return values.IdentityTrustDomain
+}
+
+// trustDomain returns the trust domain that the identities of service accounts are built from. Unless the cluster
+// domain was set explicitly, it is read from the linkerd control plane, so that the policies of a request are built
+// again when the linkerd configuration changes. The cluster domain is used if the trust domain can't be found.
+func (h Handler) trustDomain(req router.Request) (string, error) {
+	if h.clusterDomainOverride || h.identityRefs {
+		return h.clusterDomain, nil
+	}
+
+	var configMap corev1.ConfigMap
+	if err := req.Client.Get(req.Ctx, client.ObjectKey{
+		Namespace: linkerdNamespace,
+		Name:      linkerdConfigName,
+	}, &configMap); apierrors.IsNotFound(err) {
+		return h.clusterDomain, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if trustDomain := linkerdTrustDomain(&configMap); trustDomain != "" {
+		return trustDomain, nil
+	}
+	return h.clusterDomain, nil
+}
+
+// CheckLinkerdConfig logs the trust domain of the linkerd control plane and warns if the cluster domain that was set
+// explicitly doesn't match it. The policies that depend on the trust domain read the ConfigMap themselves and are
+// updated along with it. With identity refs linkerd builds the identities itself, so there is nothing to check.
+func (h Handler) CheckLinkerdConfig(req router.Request, resp router.Response) error {
+	if h.identityRefs {
+		return nil
+	}
+
+	trustDomain := linkerdTrustDomain(req.Object.(*corev1.ConfigMap))
+	if trustDomain == "" {
+		return nil
+	}
+
+	if h.clusterDomainOverride && trustDomain != h.clusterDomain {
+		logrus.Warnf("The cluster domain %s doesn't match the identity trust domain %s of linkerd, the generated identities won't match any workload", h.clusterDomain, trustDomain)
+		return nil
+	}
+	logrus.Infof("Using identity trust domain %s of linkerd", trustDomain)
+	return nil
+}
@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/acorn-io/baaah/pkg/router"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+
+	policyv1alpha1 "github.com/linkerd/linkerd2/controller/gen/apis/policy/v1alpha1"
+	serverv1beta1 "github.com/linkerd/linkerd2/controller/gen/apis/server/v1beta1"
+)
+
+const (
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "acorn-linkerd-plugin"
+)
+
+var pluginManagedSelector = labels.SelectorFromSet(map[string]string{
+	managedByLabel: managedByValue,
+})
+
+// labelManagedObjects is a middleware that labels every object a handler produces as managed by the plugin, so that
+// uninstall can find them
+func labelManagedObjects(next router.Handler) router.Handler {
+	return router.HandlerFunc(func(req router.Request, resp router.Response) error {
+		return next.Handle(req, managedResponse{Response: resp})
+	})
+}
+
+type managedResponse struct {
+	router.Response
+}
+
+func (m managedResponse) Objects(objs ...client.Object) {
+	for _, obj := range objs {
+		objLabels := obj.GetLabels()
+		if objLabels == nil {
+			objLabels = map[string]string{}
+		}
+		objLabels[managedByLabel] = managedByValue
+		obj.SetLabels(objLabels)
+	}
+	m.Response.Objects(objs...)
+}
+
+// Uninstall removes everything the plugin created: the linkerd objects labeled as managed by the plugin, the annotations
+// and finalizers the plugin added to namespaces and the annotations it added to services and builder deployments. The
+// controller must be stopped first, otherwise it creates everything again. With dryRun set nothing is changed and only
+// reported.
+func Uninstall(ctx context.Context, c client.Client, dryRun bool, out io.Writer) error {
+	action := "Deleted"
+	if dryRun {
+		action = "Would delete"
+	}
+
+	for _, list := range []client.ObjectList{
+		&policyv1alpha1.AuthorizationPolicyList{},
+		&policyv1alpha1.MeshTLSAuthenticationList{},
+		&policyv1alpha1.NetworkAuthenticationList{},
+		&serverv1beta1.ServerList{},
+		&networkingv1.NetworkPolicyList{},
+	} {
+		if err := c.List(ctx, list, &client.ListOptions{
+			LabelSelector: pluginManagedSelector,
+		}); err != nil {
+			return err
+		}
+
+		objs, err := meta.ExtractList(list)
+		if err != nil {
+			return err
+		}
+		for _, o := range objs {
+			obj := o.(client.Object)
+			gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+			if err != nil {
+				return err
+			}
+			if !dryRun {
+				if err := c.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(out, "%s %s %s/%s\n", action, gvk.Kind, obj.GetNamespace(), obj.GetName())
+		}
+	}
+
+	if err := releaseIngressEndpoints(ctx, c, dryRun, out); err != nil {
+		return err
+	}
+	if err := uninstallProjects(ctx, c, dryRun, out); err != nil {
+		return err
+	}
+	if err := uninstallServices(ctx, c, dryRun, out); err != nil {
+		return err
+	}
+	return uninstallBuilders(ctx, c, dryRun, out)
+}
+
+// uninstallProjects removes the finalizer and the annotations the plugin added from all namespaces, both projects and
+// app namespaces
+func uninstallProjects(ctx context.Context, c client.Client, dryRun bool, out io.Writer) error {
+	action := "Updated"
+	if dryRun {
+		action = "Would update"
+	}
+
+	var namespaces corev1.NamespaceList
+	if err := c.List(ctx, &namespaces); err != nil {
+		return err
+	}
+
+	for i := range namespaces.Items {
+		namespace := &namespaces.Items[i]
+		var changes []string
+		if namespace.Annotations[injectedAnnotation] == "true" {
+			delete(namespace.Annotations, injectedAnnotation)
+			delete(namespace.Annotations, serviceMeshAnnotation)
+			changes = append(changes, "removed "+serviceMeshAnnotation+" annotation")
+		}
+		if namespace.Annotations[defaultInboundPolicyAnnotation] == defaultInboundPolicyAudit {
+			delete(namespace.Annotations, defaultInboundPolicyAnnotation)
+			changes = append(changes, "removed "+defaultInboundPolicyAnnotation+" annotation")
+		}
+		if namespace.Annotations[nativeSidecarSetAnnotation] == "true" {
+			delete(namespace.Annotations, nativeSidecarSetAnnotation)
+			delete(namespace.Annotations, nativeSidecarAnnotation)
+			changes = append(changes, "removed "+nativeSidecarAnnotation+" annotation")
+		}
+		if setOpaquePorts(namespace, "") {
+			changes = append(changes, "removed "+opaquePortsAnnotation+" annotation")
+		}
+		if hasFinalizer(namespace) {
+			removeFinalizer(namespace)
+			changes = append(changes, "removed "+projectFinalizer+" finalizer")
+		}
+		if len(changes) == 0 {
+			continue
+		}
+
+		if !dryRun {
+			if err := c.Update(ctx, namespace); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "%s Namespace %s: %s\n", action, namespace.Name, strings.Join(changes, ", "))
+	}
+	return nil
+}
+
+// uninstallServices removes the opaque ports annotation the plugin added from all services
+func uninstallServices(ctx context.Context, c client.Client, dryRun bool, out io.Writer) error {
+	action := "Updated"
+	if dryRun {
+		action = "Would update"
+	}
+
+	var services corev1.ServiceList
+	if err := c.List(ctx, &services); err != nil {
+		return err
+	}
+
+	for i := range services.Items {
+		service := &services.Items[i]
+		if !setOpaquePorts(service, "") {
+			continue
+		}
+
+		if !dryRun {
+			if err := c.Update(ctx, service); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "%s Service %s/%s: removed %s annotation\n", action, service.Namespace, service.Name, opaquePortsAnnotation)
+	}
+	return nil
+}
+
+// uninstallBuilders removes the inject annotation from the pod template of the builder deployments the plugin injected
+func uninstallBuilders(ctx context.Context, c client.Client, dryRun bool, out io.Writer) error {
+	action := "Updated"
+	if dryRun {
+		action = "Would update"
+	}
+
+	var deployments appsv1.DeploymentList
+	if err := c.List(ctx, &deployments, &client.ListOptions{
+		Namespace: acornImageSystemNamespace,
+	}); err != nil {
+		return err
+	}
+
+	for i := range deployments.Items {
+		deployment := &deployments.Items[i]
+		if deployment.Annotations[injectedAnnotation] != "true" {
+			continue
+		}
+
+		delete(deployment.Annotations, injectedAnnotation)
+		delete(deployment.Spec.Template.Annotations, serviceMeshAnnotation)
+		if !dryRun {
+			if err := c.Update(ctx, deployment); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "%s Deployment %s/%s: removed %s annotation\n", action, deployment.Namespace, deployment.Name, serviceMeshAnnotation)
+	}
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	authv1 "k8s.io/api/authorization/v1"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	storagev1 "k8s.io/api/storage/v1"
@@ -28,6 +29,7 @@ func AddToScheme(scheme *runtime.Scheme) error {
 	errs = append(errs, corev1.AddToScheme(scheme))
 	errs = append(errs, appsv1.AddToScheme(scheme))
 	errs = append(errs, batchv1.AddToScheme(scheme))
+	errs = append(errs, discoveryv1.AddToScheme(scheme))
 	errs = append(errs, networkingv1.AddToScheme(scheme))
 	errs = append(errs, storagev1.AddToScheme(scheme))
 	errs = append(errs, rbacv1.AddToScheme(scheme))